@@ -4,23 +4,32 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/rtcd/whip/pkg/util"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 	"github.com/rtcd/whip/pkg/whip"
+	"github.com/rtcd/whip/pkg/whip/server"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
 	whip.Config `mapstructure:",squash"`
+	Auth        struct {
+		Tokens server.StaticTokens `mapstructure:"token"`
+		JWT    server.JWTConfig    `mapstructure:"jwt"`
+	} `mapstructure:"auth"`
+	Hooks   server.HooksConfig `mapstructure:"hooks"`
+	Publish struct {
+		// Replace lets a publisher replace the current one of its stream, see server.ReplacePublisher
+		Replace bool `mapstructure:"replace"`
+	} `mapstructure:"publish"`
 }
 
 var (
@@ -32,39 +41,249 @@ var (
 	webRoot  = "html"
 	listLock sync.RWMutex
 	conns    = make(map[string]*whipState)
+	streams  = make(map[string]*streamState)
 )
 
-func addTrack(w *whipState, t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// takeOverTimeout is how long the tracks of a stream are kept once their source
+// ended, for another publisher of the stream to take them over
+const takeOverTimeout = 5 * time.Second
+
+// streamState holds the tracks sent to the subscribers of a stream. They outlive the
+// publish sessions: the tracks of the active publisher of the stream take them over,
+// and the subscribers keep playing without being renegotiated.
+type streamState struct {
+	room, stream string
+	// simulcast layers share the track id and are told apart by their rid
+	pubTracks map[string]map[string]*whip.FanoutTrack
+	// publishers holds the publish session of the source of each track
+	publishers map[*whip.FanoutTrack]string
+	// sources holds the tracks received from each publish session
+	sources map[string][]*source
+}
+
+// source is a track received from a publisher, it is forwarded while its publisher is active
+type source struct {
+	session *server.Session
+	track   *webrtc.TrackRemote
+
+	lock   sync.Mutex
+	output *whip.FanoutTrack
+}
+
+func (src *source) setOutput(output *whip.FanoutTrack) {
+	src.lock.Lock()
+	src.output = output
+	src.lock.Unlock()
+}
+
+func (src *source) writeRTP(pkt *rtp.Packet) error {
+	src.lock.Lock()
+	output := src.output
+	src.lock.Unlock()
+	if output == nil {
+		return nil
+	}
+	return output.WriteRTP(pkt)
+}
+
+// addTrack records a track of a publisher and forwards it when its publisher is
+// active, it reports whether a track is new to the subscribers
+func addTrack(srv *server.Server, s *server.Session, t *webrtc.TrackRemote) (*streamState, *source, bool) {
 	listLock.Lock()
-	defer func() {
-		listLock.Unlock()
-	}()
+	defer listLock.Unlock()
 
-	// Create a new TrackLocal with the same codec as our incoming
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-	if err != nil {
-		panic(err)
+	st := getStream(s.Room, s.Stream)
+	src := &source{session: s, track: t}
+	st.sources[s.ID] = append(st.sources[s.ID], src)
+	if srv.Publisher(s.Room, s.Stream) != s {
+		return st, src, false
+	}
+	return st, src, st.forward(src)
+}
+
+// activate forwards the tracks of a publish session, which became the active
+// publisher of the stream. It reports whether a track is new to the subscribers.
+// listLock has to be held.
+func (st *streamState) activate(id string) bool {
+	added := false
+	for _, src := range st.sources[id] {
+		if st.forward(src) {
+			added = true
+		}
 	}
+	return added
+}
 
-	w.pubTracks[t.ID()] = trackLocal
-	return trackLocal
+// forward sends a source to the subscribers, taking over the track of another
+// publisher if any, it reports whether the track is new. listLock has to be held.
+func (st *streamState) forward(src *source) bool {
+	id, t := src.session.ID, src.track
+	if src.output != nil && st.publishers[src.output] == id {
+		return false
+	}
+	if trackLocal := st.previousTrack(id, t); trackLocal != nil {
+		err := trackLocal.SetSource(src.session.Conn, t)
+		if err == nil {
+			st.publishers[trackLocal] = id
+			src.setOutput(trackLocal)
+			return false
+		}
+		log.Printf("take over track %v: %v", trackLocal.ID(), err)
+	}
+
+	// Create a new TrackLocal with the same codec as our incoming, answering the
+	// NACKs of the subscribers and feeding their loss back to the publisher
+	trackLocal := whip.NewFanoutTrack(src.session.Conn, t)
+	if st.pubTracks[t.ID()] == nil {
+		st.pubTracks[t.ID()] = make(map[string]*whip.FanoutTrack)
+	}
+	st.pubTracks[t.ID()][t.RID()] = trackLocal
+	st.publishers[trackLocal] = id
+	src.setOutput(trackLocal)
+	return true
+}
+
+// getStream returns the state of a stream, creating it. listLock has to be held.
+func getStream(room, stream string) *streamState {
+	key := room + "/" + stream
+	st, found := streams[key]
+	if !found {
+		st = &streamState{
+			room:       room,
+			stream:     stream,
+			pubTracks:  make(map[string]map[string]*whip.FanoutTrack),
+			publishers: make(map[*whip.FanoutTrack]string),
+			sources:    make(map[string][]*source),
+		}
+		streams[key] = st
+	}
+	return st
+}
+
+// previousTrack finds the track of another publisher taken over by a track of the
+// publish session id: the track with the same id and rid, or else the same kind and rid
+func (st *streamState) previousTrack(id string, t *webrtc.TrackRemote) *whip.FanoutTrack {
+	if track := st.pubTracks[t.ID()][t.RID()]; track != nil && st.publishers[track] != id {
+		return track
+	}
+	for _, layers := range st.pubTracks {
+		if track := layers[t.RID()]; track != nil && track.Kind() == t.Kind() && st.publishers[track] != id {
+			return track
+		}
+	}
+	return nil
 }
 
-func removeTrack(w *whipState, t *webrtc.TrackLocalStaticRTP) {
+// removeTrack forgets a source once it ended, its track is removed unless it is
+// taken over within takeOverTimeout
+func removeTrack(srv *server.Server, st *streamState, src *source) {
 	listLock.Lock()
-	defer func() {
+	sources := st.sources[src.session.ID]
+	for i := range sources {
+		if sources[i] == src {
+			st.sources[src.session.ID] = append(sources[:i], sources[i+1:]...)
+			break
+		}
+	}
+	if len(st.sources[src.session.ID]) == 0 {
+		delete(st.sources, src.session.ID)
+	}
+	trackLocal := src.output
+	listLock.Unlock()
+	if trackLocal == nil {
+		return
+	}
+
+	time.AfterFunc(takeOverTimeout, func() {
+		listLock.Lock()
+		if trackLocal.Source() != src.track {
+			listLock.Unlock()
+			return
+		}
+		for id, layers := range st.pubTracks {
+			for rid, track := range layers {
+				if track == trackLocal {
+					delete(layers, rid)
+				}
+			}
+			if len(layers) == 0 {
+				delete(st.pubTracks, id)
+			}
+		}
+		delete(st.publishers, trackLocal)
+		if len(st.publishers) == 0 && srv.Publisher(st.room, st.stream) == nil {
+			delete(streams, st.room+"/"+st.stream)
+		}
 		listLock.Unlock()
-	}()
 
-	delete(w.pubTracks, t.ID())
+		syncSubscribers(srv, st)
+	})
+}
+
+// activatePublisher forwards the tracks of the new active publisher of a stream
+func activatePublisher(srv *server.Server, s *server.Session) {
+	listLock.Lock()
+	st, found := streams[s.Room+"/"+s.Stream]
+	added := found && st.activate(s.ID)
+	listLock.Unlock()
+	if added {
+		syncSubscribers(srv, st)
+	}
+}
+
+// selectLayer picks the simulcast layer with the wanted rid, falling back
+// to the first layer in rid order
+func selectLayer(layers map[string]*whip.FanoutTrack, rid string) *whip.FanoutTrack {
+	if track, found := layers[rid]; found {
+		return track
+	}
+	rids := make([]string, 0, len(layers))
+	for rid := range layers {
+		rids = append(rids, rid)
+	}
+	sort.Strings(rids)
+	return layers[rids[0]]
+}
+
+// syncSubscribers adds the new tracks of a stream to its subscribers and removes
+// the ended ones, the subscribers are renegotiated on their signaling channel
+func syncSubscribers(srv *server.Server, st *streamState) {
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	for _, s := range srv.Sessions() {
+		if s.Mode == server.ModeSubscribe && s.Room == st.room && s.Stream == st.stream {
+			if err := syncSubscriber(s, st); err != nil {
+				log.Printf("sync tracks of %v: %v", s.ID, err)
+			}
+		}
+	}
+}
+
+// syncSubscriber sends a subscriber one layer of each track of the stream,
+// picked by its rid with ?layer=. listLock has to be held.
+func syncSubscriber(s *server.Session, st *streamState) error {
+	wanted := make(map[webrtc.TrackLocal]bool)
+	for _, layers := range st.pubTracks {
+		wanted[selectLayer(layers, s.Query.Get("layer"))] = true
+	}
+	for _, track := range s.WHEP.Tracks() {
+		if wanted[track] {
+			delete(wanted, track)
+		} else if err := s.WHEP.RemoveTrack(track); err != nil {
+			return err
+		}
+	}
+	for track := range wanted {
+		if _, err := s.WHEP.AddTrack(track); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type whipState struct {
-	stream    string
-	room      string
-	publish   bool
-	whipConn  *whip.WHIPConn
-	pubTracks map[string]*webrtc.TrackLocalStaticRTP
+	session *server.Session
 }
 
 func showHelp() {
@@ -100,13 +319,34 @@ func load(file string) bool {
 }
 
 func printWhipState() {
+	listLock.RLock()
+	defer listLock.RUnlock()
 	log.Printf("State for whip:")
 	for key, conn := range conns {
 		streamType := "\tpublisher"
-		if !conn.publish {
+		if conn.session.Mode != server.ModePublish {
 			streamType = "\tsubscriber"
 		}
-		log.Printf("%v: room: %v, stream: %v, resourceId: [%v]", streamType, conn.room, conn.stream, key)
+		log.Printf("%v: room: %v, stream: %v, resourceId: [%v]", streamType, conn.session.Room, conn.session.Stream, key)
+	}
+}
+
+func logEvent(e server.Event) {
+	switch e := e.(type) {
+	case *server.TrackStarted:
+		log.Printf("track started: %v, rid: %q [%v]", e.Track.Codec().MimeType, e.Track.RID(), e.Session.ID)
+	case *server.TrackEnded:
+		log.Printf("track ended: %v, rid: %q [%v]", e.Track.Codec().MimeType, e.Track.RID(), e.Session.ID)
+	case *server.SubscriberJoined:
+		log.Printf("subscriber joined %v/%v, viewers: %d [%v]", e.Session.Room, e.Session.Stream, e.Viewers, e.Session.ID)
+	case *server.SubscriberLeft:
+		log.Printf("subscriber left %v/%v (%v), viewers: %d [%v]", e.Session.Room, e.Session.Stream, e.Reason, e.Viewers, e.Session.ID)
+		printWhipState()
+	case *server.PublisherGone:
+		log.Printf("publisher gone %v/%v (%v) [%v]", e.Session.Room, e.Session.Stream, e.Reason, e.Session.ID)
+		printWhipState()
+	case *server.ICESelectedPair:
+		log.Printf("selected candidate pair %v [%v]", e.Pair, e.Session.ID)
 	}
 }
 
@@ -128,216 +368,112 @@ func main() {
 		return
 	}
 
-	whip.Init(conf.Config)
-
-	r := mux.NewRouter()
+	engine, err := whip.NewEngine(conf.Config)
+	if err != nil {
+		log.Fatal("whip engine: ", err)
+	}
+	defer engine.Close()
 
-	r.HandleFunc("/whip/{mode}/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-		mode := vars["mode"]
-		body, err := ioutil.ReadAll(r.Body)
+	srv := server.New(engine)
+	defer srv.Close()
+	// jwt stream tokens take precedence over static tokens
+	if conf.Auth.JWT.Secret != "" || conf.Auth.JWT.PublicKey != "" {
+		jwt, err := server.NewJWTAuthorizer(conf.Auth.JWT)
 		if err != nil {
-			panic(err)
+			log.Fatal("jwt: ", err)
 		}
-		log.Printf("Post: roomId => %v, streamId => %v, body = %v", roomId, streamId, string(body))
-
+		srv.Authorizer = jwt
+	} else if len(conf.Auth.Tokens) > 0 {
+		srv.Authorizer = conf.Auth.Tokens
+	}
+	hooks := conf.Hooks
+	if len(hooks.OnPublish)+len(hooks.OnUnpublish)+len(hooks.OnPlay)+len(hooks.OnStop) > 0 {
+		srv.Hooks = server.NewHooks(hooks)
+	}
+	// a publisher reconnecting to its stream replaces its previous session, else it gets 409
+	srv.ReplacePublisher = conf.Publish.Replace
+	srv.OnPublish = func(s *server.Session) error {
 		listLock.Lock()
-		defer listLock.Unlock()
-
-		whip, err := whip.NewWHIPConn()
-
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			msg := "500 - failed to create whip conn!"
-			log.Printf("%v", msg)
-			w.Write([]byte(msg))
-			return
-		}
+		conns[s.ID] = &whipState{session: s}
+		getStream(s.Room, s.Stream)
+		listLock.Unlock()
 
-		if mode == "publish" {
-			for _, wc := range conns {
-				if wc.publish && wc.stream == streamId {
-					w.WriteHeader(http.StatusInternalServerError)
-					msg := "500 - publish conn [" + streamId + "] already exist!"
-					log.Printf("%v", msg)
-					w.Write([]byte(msg))
-					return
-				}
+		s.Conn.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			st, src, added := addTrack(srv, s, track)
+			if added {
+				syncSubscribers(srv, st)
 			}
-		}
+			defer removeTrack(srv, st, src)
 
-		state := &whipState{
-			stream:    streamId,
-			room:      roomId,
-			publish:   mode == "publish",
-			whipConn:  whip,
-			pubTracks: make(map[string]*webrtc.TrackLocalStaticRTP),
-		}
-
-		if mode == "publish" {
-			whip.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-				if track.Kind() == webrtc.RTPCodecTypeVideo {
-					// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-					// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-					go func() {
-						ticker := time.NewTicker(time.Second * 3)
-						for range ticker.C {
-							errSend := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-							if errSend != nil {
-								log.Println(errSend)
-								return
-							}
-						}
-					}()
+			for {
+				pkt, _, err := track.ReadRTP()
+				if err != nil {
+					return
 				}
 
-				pubTrack := addTrack(state, track)
-				defer removeTrack(state, pubTrack)
-
-				buf := make([]byte, 1500)
-				for {
-					i, _, err := track.Read(buf)
-					if err != nil {
-						return
-					}
-
-					if _, err = pubTrack.Write(buf[:i]); err != nil {
-						return
-					}
+				// the header extension ids (mid, rid) were negotiated with the publisher only
+				pkt.Header.Extension = false
+				pkt.Header.Extensions = nil
+				if err = src.writeRTP(pkt); err != nil {
+					return
 				}
 			}
 		}
-
-		if mode == "subscribe" {
-			foundPublish := false
-			for _, wc := range conns {
-				if wc.publish && wc.stream == streamId {
-					for trackID := range wc.pubTracks {
-						if _, err := whip.AddTrack(wc.pubTracks[trackID]); err != nil {
-							return
-						}
-					}
-					go func() {
-						time.Sleep(time.Second * 1)
-						wc.whipConn.PictureLossIndication()
-					}()
-					foundPublish = true
-				}
-			}
-			if !foundPublish {
-				w.WriteHeader(http.StatusInternalServerError)
-				msg := fmt.Sprintf("Not find any publisher for room: %v, stream: %v", roomId, streamId)
-				log.Print(msg)
-				w.Write([]byte(msg))
-				return
-			}
+		return nil
+	}
+	srv.OnSubscribe = func(s *server.Session) error {
+		listLock.Lock()
+		defer listLock.Unlock()
+		st, found := streams[s.Room+"/"+s.Stream]
+		if !found {
+			return fmt.Errorf("%w: room %v, stream %v", whip.ErrNoPublisher, s.Room, s.Stream)
 		}
-
-		uniqueResourceId := mode + "-" + streamId + "-" + util.RandomString(12)
-
-		conns[uniqueResourceId] = state
-
-		log.Printf("got offer => %v", string(body))
-		answer, err := whip.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			msg := fmt.Sprintf("failed to answer whip conn: %v", err)
-			log.Print(msg)
-			w.Write([]byte(msg))
-			return
+		if err := syncSubscriber(s, st); err != nil {
+			return err
 		}
-		log.Printf("send answer => %v", answer.SDP)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/sdp")
-		w.Header().Set("Location", "/whip/"+roomId+"/"+uniqueResourceId)
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(answer.SDP))
-
-		whip.OnConnectionStateChange = func(state webrtc.PeerConnectionState) {
-			if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
-				listLock.Lock()
-				defer listLock.Unlock()
-				if state, found := conns[uniqueResourceId]; found {
-					state.whipConn.Close()
-					delete(conns, uniqueResourceId)
-					streamType := "publish"
-					if !state.publish {
-						streamType = "subscribe"
-					}
-					log.Printf("%v stream conn removed  %v", streamType, streamId)
-				}
+		// the keyframe requests of the player are forwarded to the current publisher
+		s.WHEP.OnKeyframeRequest = func(track webrtc.TrackLocal) {
+			if fanout, ok := track.(*whip.FanoutTrack); ok {
+				fanout.RequestKeyframe()
 			}
 		}
-		printWhipState()
-	}).Methods("POST")
-
-	r.HandleFunc("/whip/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			panic(err)
-		}
-		log.Printf("Patch: roomId => %v, streamId => %v, body = %v", roomId, streamId, string(body))
+		conns[s.ID] = &whipState{session: s}
+		return nil
+	}
+	srv.OnDelete = func(s *server.Session) {
 		listLock.Lock()
-		defer listLock.Unlock()
-		if state, found := conns[streamId]; found {
-			mid := "0"
-			index := uint16(0)
-			state.whipConn.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(body), SDPMid: &mid, SDPMLineIndex: &index})
-			w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
-			w.WriteHeader(http.StatusCreated)
+		delete(conns, s.ID)
+		// the tracks of a stream are removed once their source ended, see removeTrack
+		key := s.Room + "/" + s.Stream
+		if st, found := streams[key]; found && len(st.publishers) == 0 && srv.Publisher(s.Room, s.Stream) == nil {
+			delete(streams, key)
 		}
-	}).Methods("PATCH")
-
-	r.HandleFunc("/whip/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-
-		log.Printf("Delete: roomId => %v, streamId => %v", roomId, streamId)
-
-		listLock.Lock()
-		defer listLock.Unlock()
-		if state, found := conns[streamId]; found {
-			state.whipConn.Close()
-			delete(conns, streamId)
-			streamType := "publish"
-			if !state.publish {
-				streamType = "subscribe"
-			}
-			log.Printf("%v stream conn removed  %v", streamType, streamId)
-			printWhipState()
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			msg := "stream " + streamId + " not found"
-			log.Print(msg)
-			w.Write([]byte(msg))
-			return
+		listLock.Unlock()
+	}
+	srv.Events().OnEvent(logEvent)
+	// the tracks of a backup publisher take over when the primary fails, and back
+	srv.Events().OnEvent(func(e server.Event) {
+		if e, ok := e.(*server.PublisherActivated); ok {
+			activatePublisher(srv, e.Session)
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(streamId + " deleted"))
-	}).Methods("DELETE")
+	})
+
+	r := mux.NewRouter()
 
 	r.HandleFunc("/whip/list", func(w http.ResponseWriter, r *http.Request) {
-		listLock.Lock()
-		defer listLock.Unlock()
 		var list []map[string]interface{}
-		for key, item := range conns {
+		for _, item := range srv.Sessions() {
 			details := make(map[string]interface{})
-
-			connType := "publish"
-			if !item.publish {
-				connType = "subscribe"
+			details["path"] = item.Room + "/" + item.Stream
+			details["type"] = item.Mode
+			details["uniqueID"] = item.ID
+			details["room"] = item.Room
+			details["stream"] = item.Stream
+			if item.Conn != nil {
+				details["stats"] = item.Conn.Stats()
+			} else {
+				details["stats"] = item.WHEP.Stats()
 			}
-			details["path"] = item.room + "/" + item.stream
-			details["type"] = connType
-			details["uniqueID"] = key
-			details["room"] = item.room
-			details["stream"] = item.stream
 			list = append(list, details)
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -345,6 +481,9 @@ func main() {
 		json.NewEncoder(w).Encode(list)
 	}).Methods("GET")
 
+	r.Handle("/metrics", srv.MetricsHandler()).Methods("GET")
+	r.PathPrefix("/whip/").Handler(srv)
+	r.PathPrefix("/whep/").Handler(srv)
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(webRoot))))
 	r.Headers("Access-Control-Allow-Origin", "*")
 
@@ -4,23 +4,22 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/rtcd/whip/pkg/util"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mdp/qrterminal/v3"
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/rtcd/whip/internal/gst-sink"
 	gst_sink "github.com/rtcd/whip/internal/gst-sink"
 	"github.com/rtcd/whip/pkg/whip"
+	"github.com/rtcd/whip/pkg/whip/server"
 )
 
 var (
@@ -36,6 +35,9 @@ var (
 	conns    = make(map[string]*whipState)
 )
 
+// gopInterval is the interval of the keyframes requested for the rtmp stream
+const gopInterval = 3 * time.Second
+
 type whipState struct {
 	id       string
 	whipConn *whip.WHIPConn
@@ -85,6 +87,11 @@ func showHelp() {
 	fmt.Println("      -h (show help info)")
 }
 
+// the glib main loop has to run on the main thread, see gst.StartMainLoop
+func init() {
+	runtime.LockOSThread()
+}
+
 func main() {
 	flag.StringVar(&cert, "cert", "", "cert file")
 	flag.StringVar(&key, "key", "", "key file")
@@ -101,141 +108,78 @@ func main() {
 		return
 	}
 
-	r := mux.NewRouter()
-
-	r.HandleFunc("/whip/{mode}/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			panic(err)
-		}
-		rtmpUrl := "rtmp://" + rtmpSrv + "/" + roomId + "/" + streamId
-		log.Printf("Post: roomId => %v, streamId => %v, body = %v, publish to %v", roomId, streamId, string(body), rtmpUrl)
-
-		listLock.Lock()
-		defer listLock.Unlock()
+	engine, err := whip.NewEngine(whip.Config{})
+	if err != nil {
+		log.Fatal("whip engine: ", err)
+	}
+	defer engine.Close()
 
-		if _, found := conns[streamId]; !found {
-			whip, err := whip.NewWHIPConn()
+	srv := server.New(engine)
+	// the rtmp pipeline only takes opus audio and the selected video codec
+	srv.Codecs = func(mode, room, stream string) []whip.CodecConfig {
+		return []whip.CodecConfig{{Name: "opus"}, {Name: vcodec}}
+	}
+	srv.OnPublish = func(s *server.Session) error {
+		rtmpUrl := "rtmp://" + rtmpSrv + "/" + s.Room + "/" + s.Stream
+		log.Printf("Publish: roomId => %v, streamId => %v, publish to %v", s.Room, s.Stream, rtmpUrl)
 
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("500 - failed to create whip conn!"))
-				return
-			}
+		state := newWhipState(s.ID, s.Conn)
+		state.pipeline = gst.CreatePipeline(rtmpUrl, vcodec)
+		state.pipeline.Start()
 
-			state := newWhipState(streamId, whip)
-			state.pipeline = gst.CreatePipeline(rtmpUrl, vcodec)
-			state.pipeline.Start()
-
-			whip.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-
-				if track.Kind() == webrtc.RTPCodecTypeVideo {
-					// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-					// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-					go func() {
-						ticker := time.NewTicker(time.Second * 3)
-						for range ticker.C {
-							errSend := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-							if errSend != nil {
-								log.Println(errSend)
-								return
-							}
+		listLock.Lock()
+		conns[s.ID] = state
+		listLock.Unlock()
+
+		s.Conn.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				// rtmp players start at a keyframe, so the stream needs one every gopInterval
+				done := make(chan struct{})
+				defer close(done)
+				go func() {
+					ticker := time.NewTicker(gopInterval)
+					defer ticker.Stop()
+					for {
+						s.Conn.RequestKeyframe(track)
+						select {
+						case <-ticker.C:
+						case <-done:
+							return
 						}
-					}()
-				}
-				mimeType := track.Codec().RTPCodecCapability.MimeType
-				codecType := strings.Split(mimeType, "/")[0]
-
-				buf := make([]byte, 1500)
-				for {
-					i, _, err := track.Read(buf)
-					if err != nil {
-						return
 					}
-					state.pipeline.Push(buf[:i], codecType)
-				}
-			}
-			uniqueResourceId := streamId + "-" + util.RandomString(12)
-
-			conns[uniqueResourceId] = state
-			log.Printf("got offer => %v", string(body))
-			answer, err := whip.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(fmt.Sprintf("failed to answer whip conn: %v", err)))
-				return
+				}()
 			}
-			log.Printf("send answer => %v", answer.SDP)
-
-			w.Header().Set("Content-Type", "application/sdp")
-			w.Header().Set("Location", "/whip/"+roomId+"/"+uniqueResourceId)
-			w.WriteHeader(http.StatusCreated)
-			w.Write([]byte(answer.SDP))
-
-			whip.OnConnectionStateChange = func(state webrtc.PeerConnectionState) {
-				if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
-					listLock.Lock()
-					defer listLock.Unlock()
-					if state, found := conns[uniqueResourceId]; found {
-						state.whipConn.Close()
-						delete(conns, uniqueResourceId)
-						log.Printf("%v stream conn removed", streamId)
-					}
+			mimeType := track.Codec().RTPCodecCapability.MimeType
+			codecType := strings.Split(mimeType, "/")[0]
+
+			buf := make([]byte, 1500)
+			for {
+				i, _, err := track.Read(buf)
+				if err != nil {
+					return
 				}
+				state.pipeline.Push(buf[:i], codecType)
 			}
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("stream " + streamId + " already exists"))
-			return
 		}
-	}).Methods("POST", "GET")
-
-	r.HandleFunc("/whip/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			panic(err)
-		}
-		log.Printf("Patch: roomId => %v, streamId => %v, body = %v", roomId, streamId, string(body))
-		listLock.Lock()
-		defer listLock.Unlock()
-		if state, found := conns[streamId]; found {
-			mid := "0"
-			index := uint16(0)
-			state.whipConn.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(body), SDPMid: &mid, SDPMLineIndex: &index})
-
-			w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
-			w.WriteHeader(http.StatusCreated)
-		}
-	}).Methods("PATCH")
-
-	r.HandleFunc("/whip/{room}/{stream}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomId := vars["room"]
-		streamId := vars["stream"]
-
-		log.Printf("Delete: roomId => %v, streamId => %v", roomId, streamId)
-
+		return nil
+	}
+	srv.OnDelete = func(s *server.Session) {
 		listLock.Lock()
 		defer listLock.Unlock()
-		if state, found := conns[streamId]; found {
-			state.whipConn.Close()
+		if state, found := conns[s.ID]; found {
 			state.pipeline.Stop()
-			delete(conns, streamId)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("stream " + streamId + " not found"))
-			return
+			delete(conns, s.ID)
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(streamId + " deleted"))
-	}).Methods("DELETE")
+	}
+
+	srv.AddCounter("whip_gst_pipeline_errors_total", "Errors reported by the gstreamer pipelines.", func() float64 {
+		return float64(gst.Errors())
+	})
 
+	r := mux.NewRouter()
+	r.Handle("/metrics", srv.MetricsHandler()).Methods("GET")
+	r.PathPrefix("/whip/").Handler(srv)
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(webRoot))))
 	/*
 		if localIp, err := getClientIp(); err == nil {
@@ -243,13 +187,18 @@ func main() {
 		}
 	*/
 
-	if cert != "" && key != "" {
-		if e := http.ListenAndServeTLS(addr, cert, key, r); e != nil {
-			log.Fatal("ListenAndServeTLS: ", e)
-		}
-	} else {
-		if e := http.ListenAndServe(addr, r); e != nil {
-			log.Fatal("ListenAndServe: ", e)
+	go func() {
+		if cert != "" && key != "" {
+			if e := http.ListenAndServeTLS(addr, cert, key, r); e != nil {
+				log.Fatal("ListenAndServeTLS: ", e)
+			}
+		} else {
+			if e := http.ListenAndServe(addr, r); e != nil {
+				log.Fatal("ListenAndServe: ", e)
+			}
 		}
-	}
+	}()
+
+	// the bus watches of the pipelines, counting their errors, run on the main loop
+	gst.StartMainLoop()
 }
@@ -7,6 +7,7 @@ require (
 	github.com/mdp/qrterminal/v3 v3.0.0
 	github.com/pion/interceptor v0.1.0
 	github.com/pion/rtcp v1.2.8
+	github.com/pion/rtp v1.7.2
 	github.com/pion/webrtc/v3 v3.1.5
 	github.com/spf13/viper v1.12.0
 )
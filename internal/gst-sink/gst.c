@@ -29,6 +29,7 @@ static gboolean gstreamer_receive_bus_call(GstBus *bus, GstMessage *msg, gpointe
 
     g_printerr("Error: %s\n", error->message);
     g_error_free(error);
+    goHandlePipelineError();
   }
   default:
     break;
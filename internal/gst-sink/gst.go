@@ -9,9 +9,22 @@ package gst
 */
 import "C"
 import (
+	"sync/atomic"
 	"unsafe"
 )
 
+var pipelineErrors uint64
+
+// Errors counts the errors reported by the pipelines
+func Errors() uint64 {
+	return atomic.LoadUint64(&pipelineErrors)
+}
+
+//export goHandlePipelineError
+func goHandlePipelineError() {
+	atomic.AddUint64(&pipelineErrors, 1)
+}
+
 // StartMainLoop starts GLib's main loop
 // It needs to be called from the process' main thread
 // Because many gstreamer plugins require access to the main thread
@@ -0,0 +1,89 @@
+package signaling
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ParseICEServerLinks parses Link header values with rel="ice-server"
+func ParseICEServerLinks(links []string) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	for _, header := range links {
+		for _, link := range splitLinks(header) {
+			server, ok := parseICEServerLink(link)
+			if ok {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
+
+func parseICEServerLink(link string) (webrtc.ICEServer, bool) {
+	var server webrtc.ICEServer
+	link = strings.TrimSpace(link)
+	end := strings.Index(link, ">")
+	if !strings.HasPrefix(link, "<") || end < 0 {
+		return server, false
+	}
+	if _, err := url.Parse(link[1:end]); err != nil {
+		return server, false
+	}
+	server.URLs = []string{link[1:end]}
+
+	isICEServer := false
+	for _, param := range splitOutsideQuotes(link[end+1:], ';') {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := unquote(strings.TrimSpace(kv[1]))
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "rel":
+			isICEServer = value == "ice-server"
+		case "username":
+			server.Username = value
+		case "credential":
+			server.Credential = value
+		}
+	}
+	return server, isICEServer
+}
+
+// splitLinks splits a Link header holding several comma separated links
+func splitLinks(header string) []string {
+	return splitOutsideQuotes(header, ',')
+}
+
+func splitOutsideQuotes(s string, sep rune) []string {
+	var parts []string
+	var quoted, escaped, inURL bool
+	start := 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"' && !inURL:
+			quoted = !quoted
+		case r == '<' && !quoted:
+			inURL = true
+		case r == '>' && !quoted:
+			inURL = false
+		case r == sep && !quoted && !inURL:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s[1 : len(s)-1])
+}
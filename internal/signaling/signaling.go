@@ -0,0 +1,123 @@
+// Package signaling holds the HTTP signaling shared by the WHIP and WHEP clients.
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrNoLocation is returned when the server created a resource without a Location header
+var ErrNoLocation = errors.New("response has no Location header")
+
+// StatusError is returned when the server answers a request with an unexpected status
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v: unexpected status %d: %v", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// Client sends the signaling requests
+type Client struct {
+	// Token, if set, is sent as a bearer token
+	Token string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Do sends a request and reads the whole response body
+func (c *Client) Do(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, []byte, error) {
+	return c.do(ctx, method, url, contentType, "", body)
+}
+
+// Patch sends a PATCH request, conditional on etag when it is not empty
+func (c *Client) Patch(ctx context.Context, url, contentType, etag string, body []byte) (*http.Response, []byte, error) {
+	return c.do(ctx, http.MethodPatch, url, contentType, etag, body)
+}
+
+func (c *Client) do(ctx context.Context, method, url, contentType, etag string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, resBody, nil
+}
+
+// Expect checks the status of a response
+func Expect(res *http.Response, body []byte, codes ...int) error {
+	for _, code := range codes {
+		if res.StatusCode == code {
+			return nil
+		}
+	}
+	return &StatusError{Method: res.Request.Method, URL: res.Request.URL.String(), StatusCode: res.StatusCode, Body: string(body)}
+}
+
+// Options fetches the ice servers advertised by an endpoint
+func (c *Client) Options(ctx context.Context, url string) ([]webrtc.ICEServer, error) {
+	res, _, err := c.Do(ctx, http.MethodOptions, url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return ParseICEServerLinks(res.Header.Values("Link")), nil
+}
+
+// Delete deletes a resource
+func (c *Client) Delete(ctx context.Context, url string) error {
+	res, body, err := c.Do(ctx, http.MethodDelete, url, "", nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{Method: http.MethodDelete, URL: url, StatusCode: res.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// DefaultAPI creates an API like webrtc.NewPeerConnection does
+func DefaultAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
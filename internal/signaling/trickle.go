@@ -0,0 +1,130 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+// Trickler sends the local candidates of a PeerConnection to a resource with PATCH.
+// Candidates gathered before Start are queued.
+type Trickler struct {
+	client *Client
+	pc     *webrtc.PeerConnection
+
+	lock       sync.Mutex
+	notify     chan struct{}
+	location   string
+	etag       string
+	candidates []webrtc.ICECandidateInit
+	ended      bool
+	stopped    bool
+}
+
+// NewTrickler creates a Trickler collecting the candidates of pc
+func NewTrickler(client *Client, pc *webrtc.PeerConnection) *Trickler {
+	t := &Trickler{
+		client: client,
+		pc:     pc,
+		notify: make(chan struct{}, 1),
+	}
+	pc.OnICECandidate(t.onICECandidate)
+	return t
+}
+
+// Start sends the queued and later candidates to location, conditional on
+// the etag of the ice session when it is not empty
+func (t *Trickler) Start(location, etag string) {
+	t.lock.Lock()
+	t.location = location
+	t.etag = etag
+	t.lock.Unlock()
+	go t.run()
+	t.signal()
+}
+
+// Stop stops sending candidates
+func (t *Trickler) Stop() {
+	t.lock.Lock()
+	t.stopped = true
+	t.lock.Unlock()
+	t.signal()
+}
+
+func (t *Trickler) signal() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Trickler) onICECandidate(candidate *webrtc.ICECandidate) {
+	t.lock.Lock()
+	if candidate == nil {
+		t.ended = true
+	} else {
+		t.candidates = append(t.candidates, candidate.ToJSON())
+	}
+	t.lock.Unlock()
+	t.signal()
+}
+
+// run sends the gathered candidates until gathering ends
+func (t *Trickler) run() {
+	for range t.notify {
+		t.lock.Lock()
+		candidates := t.candidates
+		t.candidates = nil
+		ended := t.ended
+		stopped := t.stopped
+		location := t.location
+		etag := t.etag
+		t.lock.Unlock()
+
+		if stopped {
+			return
+		}
+		if len(candidates) == 0 && !ended {
+			continue
+		}
+
+		frag := t.sdpFrag(candidates, ended)
+		res, body, err := t.client.Patch(context.Background(), location, whip.SDPFragContentType, etag, []byte(frag))
+		if err != nil || res.StatusCode < 200 || res.StatusCode > 299 {
+			// the endpoint does not support trickle ice, stop sending candidates
+			return
+		}
+		if res.StatusCode == http.StatusOK && res.Header.Get("Content-Type") == whip.SDPFragContentType {
+			t.addRemoteCandidates(string(body))
+		}
+		if ended {
+			return
+		}
+	}
+}
+
+// addRemoteCandidates adds the server candidates trickled back in a PATCH response
+func (t *Trickler) addRemoteCandidates(body string) {
+	frag, err := whip.ParseSDPFrag(body)
+	if err != nil {
+		return
+	}
+	for _, media := range frag.Media {
+		for _, candidate := range media.Candidates {
+			mid := media.Mid
+			t.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate, SDPMid: &mid})
+		}
+	}
+}
+
+// sdpFrag builds the application/trickle-ice-sdpfrag body of the candidates
+func (t *Trickler) sdpFrag(candidates []webrtc.ICECandidateInit, ended bool) string {
+	desc := t.pc.LocalDescription()
+	if desc == nil {
+		return ""
+	}
+	return whip.NewSDPFrag(*desc, candidates, ended).String()
+}
@@ -0,0 +1,287 @@
+// Package client subscribes to a remote WHEP endpoint and hands back the received tracks.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rtcd/whip/internal/signaling"
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+// ErrNoLocation is returned when the server created a resource without a Location header
+var ErrNoLocation = signaling.ErrNoLocation
+
+// StatusError is returned when the server answers a request with an unexpected status
+type StatusError = signaling.StatusError
+
+// Client subscribes to a WHEP endpoint
+type Client struct {
+	// URL of the WHEP endpoint
+	URL string
+	// Token, if set, is sent as a bearer token
+	Token string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// API defaults to an API with the pion default codecs and interceptors
+	API *webrtc.API
+	// Configuration of the PeerConnection. When it has no ICEServers, those
+	// advertised by the endpoint on OPTIONS are used.
+	Configuration webrtc.Configuration
+	// ServerOffer asks the endpoint for its offer with an empty POST and sends
+	// the answer with PATCH, instead of offering one audio and one video track.
+	ServerOffer bool
+}
+
+// Session is a subscribed WHEP resource. The tracks added or removed by the
+// endpoint later are renegotiated on its signaling data channel.
+type Session struct {
+	// Location is the absolute resource URL
+	Location string
+	// ICEServers are the ice servers advertised in the POST response
+	ICEServers []webrtc.ICEServer
+
+	signal   *signaling.Client
+	pc       *webrtc.PeerConnection
+	trickler *signaling.Trickler
+	tracks   chan *webrtc.TrackRemote
+	rtcp     chan []rtcp.Packet
+	done     chan struct{}
+	etag     string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// rtcpBuffer is the number of RTCP packet batches kept until they are read
+const rtcpBuffer = 16
+
+// Subscribe negotiates a session with the endpoint. The received tracks are
+// delivered on Tracks once their media starts flowing.
+func (c *Client) Subscribe(ctx context.Context) (*Session, error) {
+	signal := &signaling.Client{Token: c.Token, HTTPClient: c.HTTPClient}
+
+	config := c.Configuration
+	if len(config.ICEServers) == 0 {
+		iceServers, err := signal.Options(ctx, c.URL)
+		if err != nil {
+			return nil, err
+		}
+		config.ICEServers = iceServers
+	}
+
+	api := c.API
+	if api == nil {
+		var err error
+		if api, err = signaling.DefaultAPI(); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		signal: signal,
+		pc:     pc,
+		tracks: make(chan *webrtc.TrackRemote),
+		rtcp:   make(chan []rtcp.Packet, rtcpBuffer),
+		done:   make(chan struct{}),
+	}
+	s.trickler = signaling.NewTrickler(signal, pc)
+	pc.OnTrack(s.onTrack)
+	// the endpoint opens the signaling channel of a server offer
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == whip.SignalingLabel {
+			s.setSignaling(dc)
+		}
+	})
+
+	if c.ServerOffer {
+		err = s.answer(ctx, c.URL)
+	} else {
+		err = s.offer(ctx, c.URL)
+	}
+	if err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+
+	s.trickler.Start(s.Location, s.etag)
+
+	return s, nil
+}
+
+// offer sends the offer of a recvonly audio and video transceiver and of the signaling channel
+func (s *Session) offer(ctx context.Context, url string) error {
+	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := s.pc.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return err
+		}
+	}
+	dc, err := s.pc.CreateDataChannel(whip.SignalingLabel, nil)
+	if err != nil {
+		return err
+	}
+	s.setSignaling(dc)
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = s.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	answer, err := s.post(ctx, url, []byte(offer.SDP))
+	if err != nil {
+		return err
+	}
+	return s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+}
+
+// answer answers the offer returned for an empty POST
+func (s *Session) answer(ctx context.Context, url string) error {
+	offer, err := s.post(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	if err = s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return err
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = s.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	res, body, err := s.signal.Do(ctx, http.MethodPatch, s.Location, "application/sdp", []byte(answer.SDP))
+	if err != nil {
+		return err
+	}
+	return signaling.Expect(res, body, http.StatusOK, http.StatusNoContent)
+}
+
+// post creates the resource and returns the sdp of the response
+func (s *Session) post(ctx context.Context, url string, sdp []byte) (string, error) {
+	contentType := ""
+	if len(sdp) > 0 {
+		contentType = "application/sdp"
+	}
+	res, body, err := s.signal.Do(ctx, http.MethodPost, url, contentType, sdp)
+	if err != nil {
+		return "", err
+	}
+	if err = signaling.Expect(res, body, http.StatusCreated); err != nil {
+		return "", err
+	}
+
+	location, err := res.Location()
+	if err != nil {
+		return "", ErrNoLocation
+	}
+	s.Location = location.String()
+	s.etag = res.Header.Get("ETag")
+	s.ICEServers = signaling.ParseICEServerLinks(res.Header.Values("Link"))
+	return string(body), nil
+}
+
+// setSignaling answers the offers of the endpoint sent on the signaling channel
+func (s *Session) setSignaling(dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(msg.Data, &offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+			log.Printf("unexpected signaling message: %s", msg.Data)
+			return
+		}
+		if err := s.renegotiate(dc, offer); err != nil {
+			log.Printf("renegotiation: %v", err)
+		}
+	})
+}
+
+func (s *Session) renegotiate(dc *webrtc.DataChannel, offer webrtc.SessionDescription) error {
+	if err := s.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = s.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	msg, err := json.Marshal(s.pc.LocalDescription())
+	if err != nil {
+		return err
+	}
+	return dc.SendText(string(msg))
+}
+
+func (s *Session) onTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	// read RTCP so the interceptors process it, and hand it out without blocking
+	go func() {
+		for {
+			packets, _, err := receiver.ReadRTCP()
+			if err != nil {
+				return
+			}
+			select {
+			case s.rtcp <- packets:
+			default:
+			}
+		}
+	}()
+
+	select {
+	case s.tracks <- track:
+	case <-s.done:
+	}
+}
+
+// Tracks delivers the remote tracks as they start, it has to be read for the tracks to be delivered
+func (s *Session) Tracks() <-chan *webrtc.TrackRemote {
+	return s.tracks
+}
+
+// RTCP delivers the RTCP packets received from the endpoint, packets are
+// dropped when the channel is not drained
+func (s *Session) RTCP() <-chan []rtcp.Packet {
+	return s.rtcp
+}
+
+// WriteRTCP sends RTCP packets, e.g. a PictureLossIndication, to the endpoint
+func (s *Session) WriteRTCP(packets []rtcp.Packet) error {
+	return s.pc.WriteRTCP(packets)
+}
+
+// PeerConnection returns the PeerConnection of the session
+func (s *Session) PeerConnection() *webrtc.PeerConnection {
+	return s.pc
+}
+
+// Close deletes the resource and closes the PeerConnection
+func (s *Session) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.trickler.Stop()
+		if s.Location != "" {
+			s.closeErr = s.signal.Delete(ctx, s.Location)
+		}
+		if err := s.pc.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
@@ -0,0 +1,197 @@
+// Package client publishes local tracks to a remote WHIP endpoint.
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rtcd/whip/internal/signaling"
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+// ErrNoLocation is returned when the server created a resource without a Location header
+var ErrNoLocation = signaling.ErrNoLocation
+
+// StatusError is returned when the server answers a request with an unexpected status
+type StatusError = signaling.StatusError
+
+// Client publishes to a WHIP endpoint
+type Client struct {
+	// URL of the WHIP endpoint
+	URL string
+	// Token, if set, is sent as a bearer token
+	Token string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// API defaults to an API with the pion default codecs and interceptors
+	API *webrtc.API
+	// Configuration of the PeerConnection. When it has no ICEServers, those
+	// advertised by the endpoint on OPTIONS are used.
+	Configuration webrtc.Configuration
+}
+
+// Session is a published WHIP resource
+type Session struct {
+	// Location is the absolute resource URL
+	Location string
+	// ICEServers are the ice servers advertised in the POST response
+	ICEServers []webrtc.ICEServer
+
+	signal   *signaling.Client
+	pc       *webrtc.PeerConnection
+	senders  []*webrtc.RTPSender
+	trickler *signaling.Trickler
+	etag     string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Publish offers tracks to the endpoint. The offer is sent before ICE gathering
+// completes, the remaining candidates are trickled to the resource with PATCH.
+func (c *Client) Publish(ctx context.Context, tracks ...webrtc.TrackLocal) (*Session, error) {
+	signal := &signaling.Client{Token: c.Token, HTTPClient: c.HTTPClient}
+
+	config := c.Configuration
+	if len(config.ICEServers) == 0 {
+		iceServers, err := signal.Options(ctx, c.URL)
+		if err != nil {
+			return nil, err
+		}
+		config.ICEServers = iceServers
+	}
+
+	api := c.API
+	if api == nil {
+		var err error
+		if api, err = signaling.DefaultAPI(); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		signal: signal,
+		pc:     pc,
+	}
+
+	for _, track := range tracks {
+		transceiver, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		s.senders = append(s.senders, transceiver.Sender())
+	}
+
+	s.trickler = signaling.NewTrickler(signal, pc)
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	res, body, err := signal.Do(ctx, http.MethodPost, c.URL, "application/sdp", []byte(offer.SDP))
+	if err == nil {
+		err = signaling.Expect(res, body, http.StatusCreated)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	location, err := res.Location()
+	if err != nil {
+		pc.Close()
+		return nil, ErrNoLocation
+	}
+	s.Location = location.String()
+	s.etag = res.Header.Get("ETag")
+	s.ICEServers = signaling.ParseICEServerLinks(res.Header.Values("Link"))
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}); err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+
+	s.trickler.Start(s.Location, s.etag)
+
+	return s, nil
+}
+
+// PeerConnection returns the PeerConnection of the session
+func (s *Session) PeerConnection() *webrtc.PeerConnection {
+	return s.pc
+}
+
+// Senders returns the RTPSenders of the published tracks, in the order given to Publish
+func (s *Session) Senders() []*webrtc.RTPSender {
+	return s.senders
+}
+
+// RestartICE restarts ICE on the resource, e.g. after a network change, keeping
+// its Location. The candidates are gathered before the restart is sent.
+func (s *Session) RestartICE(ctx context.Context) error {
+	// candidates of the new ice session are not trickled
+	s.trickler.Stop()
+
+	offer, err := s.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(s.pc)
+	if err = s.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	etag := s.etag
+	if etag == "" {
+		etag = "*"
+	}
+	frag := whip.DescriptionSDPFrag(*s.pc.LocalDescription())
+	res, body, err := s.signal.Patch(ctx, s.Location, whip.SDPFragContentType, etag, []byte(frag.String()))
+	if err == nil {
+		err = signaling.Expect(res, body, http.StatusOK)
+	}
+	if err != nil {
+		return err
+	}
+
+	remote, err := whip.ParseSDPFrag(string(body))
+	if err != nil {
+		return err
+	}
+	s.etag = res.Header.Get("ETag")
+	answer := whip.ApplySDPFrag(*s.pc.RemoteDescription(), remote)
+	answer.Type = webrtc.SDPTypeAnswer
+	return s.pc.SetRemoteDescription(answer)
+}
+
+// Close deletes the resource and closes the PeerConnection
+func (s *Session) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.trickler.Stop()
+		s.closeErr = s.signal.Delete(ctx, s.Location)
+		if err := s.pc.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
@@ -0,0 +1,209 @@
+package whip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// mime types are cased as in pion, whose fmtp matching is case sensitive
+const (
+	mimeTypeH264 = "video/H264"
+	mimeTypeH265 = "video/H265"
+	mimeTypeVP8  = "video/VP8"
+	mimeTypeVP9  = "video/VP9"
+	mimeTypeAV1  = "video/AV1"
+	mimeTypeOpus = "audio/opus"
+	mimeTypePCMA = "audio/PCMA"
+	mimeTypePCMU = "audio/PCMU"
+	mimeTypeG722 = "audio/G722"
+)
+
+// CodecConfig selects a codec by name: opus, pcma, pcmu, g722, vp8, vp9, av1, h264 or h265.
+// Zero fields take the defaults of the codec, so several entries of one codec,
+// e.g. H264 with different profile-level-ids, need distinct payload types.
+type CodecConfig struct {
+	Name        string `mapstructure:"name"`
+	PayloadType uint8  `mapstructure:"payloadtype"`
+	ClockRate   uint32 `mapstructure:"clockrate"`
+	Channels    uint16 `mapstructure:"channels"`
+	Fmtp        string `mapstructure:"fmtp"`
+}
+
+type codecDefault struct {
+	kind   webrtc.RTPCodecType
+	params webrtc.RTPCodecParameters
+}
+
+var codecDefaults = map[string]codecDefault{
+	"opus": {webrtc.RTPCodecTypeAudio, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}},
+	"pcmu": {webrtc.RTPCodecTypeAudio, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypePCMU, ClockRate: 8000},
+		PayloadType:        0,
+	}},
+	"pcma": {webrtc.RTPCodecTypeAudio, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypePCMA, ClockRate: 8000},
+		PayloadType:        8,
+	}},
+	"g722": {webrtc.RTPCodecTypeAudio, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeG722, ClockRate: 8000},
+		PayloadType:        9,
+	}},
+	"vp8": {webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}},
+	"vp9": {webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		PayloadType:        98,
+	}},
+	"h264": {webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		PayloadType:        102,
+	}},
+	"h265": {webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeH265, ClockRate: 90000},
+		PayloadType:        104,
+	}},
+	"av1": {webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeAV1, ClockRate: 90000},
+		PayloadType:        45,
+	}},
+}
+
+// DefaultCodecs are used when no codec is configured
+var DefaultCodecs = []CodecConfig{{Name: "pcma"}, {Name: "opus"}, {Name: "vp8"}, {Name: "h264"}}
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+var simulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// registerSimulcastExtensions registers the mid, rid and repaired-rid header
+// extensions used to demultiplex the layers of a simulcast video stream
+func registerSimulcastExtensions(m *webrtc.MediaEngine) error {
+	for _, extension := range simulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: simulcastExtensions[0]}, webrtc.RTPCodecTypeAudio)
+}
+
+type codecSet struct {
+	audio []webrtc.RTPCodecParameters
+	video []webrtc.RTPCodecParameters
+}
+
+// newCodecSet resolves codec configs into codec parameters
+func newCodecSet(configs []CodecConfig) (*codecSet, error) {
+	set := &codecSet{}
+	payloadTypes := make(map[webrtc.PayloadType]string)
+
+	for _, c := range configs {
+		def, ok := codecDefaults[strings.ToLower(c.Name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported codec %q", c.Name)
+		}
+
+		params := def.params
+		if c.PayloadType != 0 {
+			params.PayloadType = webrtc.PayloadType(c.PayloadType)
+		}
+		if c.ClockRate != 0 {
+			params.ClockRate = c.ClockRate
+		}
+		if c.Channels != 0 {
+			params.Channels = c.Channels
+		}
+		if c.Fmtp != "" {
+			params.SDPFmtpLine = c.Fmtp
+		}
+
+		if name, found := payloadTypes[params.PayloadType]; found {
+			return nil, fmt.Errorf("codec %q and %q share payload type %d", name, c.Name, params.PayloadType)
+		}
+		payloadTypes[params.PayloadType] = c.Name
+
+		if def.kind == webrtc.RTPCodecTypeVideo {
+			params.RTCPFeedback = videoRTCPFeedback
+			set.video = append(set.video, params)
+		} else {
+			set.audio = append(set.audio, params)
+		}
+	}
+	return set, nil
+}
+
+// register registers the codecs with a MediaEngine
+func (c *codecSet) register(m *webrtc.MediaEngine) error {
+	for _, codec := range c.audio {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+
+	for _, codec := range c.video {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supports reports whether the set has a codec of mimeType
+func (c *codecSet) supports(mimeType string) bool {
+	for _, codecs := range [][]webrtc.RTPCodecParameters{c.audio, c.video} {
+		for _, codec := range codecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOffer returns ErrUnsupportedCodec when an audio or video media section
+// of an offer, not rejected with port 0, has none of the codecs of the set
+func (c *codecSet) checkOffer(sdp string) error {
+	kind := ""
+	active, supported := false, false
+	check := func() error {
+		if active && !supported {
+			return fmt.Errorf("%w for %v", ErrUnsupportedCodec, kind)
+		}
+		return nil
+	}
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if err := check(); err != nil {
+				return err
+			}
+			// m=<media> <port> <proto> <fmt> ...
+			fields := strings.Fields(line[2:])
+			if len(fields) == 0 {
+				return fmt.Errorf("%w: empty media line", ErrBadOffer)
+			}
+			kind = fields[0]
+			active = (kind == "audio" || kind == "video") && len(fields) > 1 && fields[1] != "0"
+			supported = false
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			// a=rtpmap:<payload type> <encoding name>/<clock rate>
+			if fields := strings.Fields(line[len("a=rtpmap:"):]); len(fields) == 2 {
+				name := strings.SplitN(fields[1], "/", 2)[0]
+				supported = supported || c.supports(kind+"/"+name)
+			}
+		}
+	}
+	return check()
+}
@@ -0,0 +1,142 @@
+package whip
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rtcd/whip/pkg/util"
+)
+
+const defaultTURNCredentialTTL = 24 * time.Hour
+
+// Engine holds the network settings and codecs shared by the WHIPConns it creates.
+// Several engines with different configs can live in one process.
+type Engine struct {
+	settings   webrtc.SettingEngine
+	udpMux     io.Closer
+	iceServers []ICEServerConfig
+	iceLite    bool
+	codecs     *codecSet
+	// gatherTimeout bounds ICE gathering before answering, zero waits for completion
+	gatherTimeout time.Duration
+}
+
+// NewEngine creates an Engine from config, binding the single-port UDP listener if configured
+func NewEngine(c Config) (*Engine, error) {
+	codecs := c.Codecs
+	if len(codecs) == 0 {
+		codecs = DefaultCodecs
+	}
+	codecSet, err := newCodecSet(codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Engine{
+		codecs:        codecSet,
+		gatherTimeout: time.Duration(c.WebRTC.GatherTimeout) * time.Millisecond,
+	}
+
+	if c.WebRTC.ICESinglePort != 0 {
+		log.Print("Listen on ", "single-port: ", c.WebRTC.ICESinglePort)
+		udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
+			IP:   net.IP{0, 0, 0, 0},
+			Port: c.WebRTC.ICESinglePort,
+		})
+		if err != nil {
+			return nil, err
+		}
+		udpMux := webrtc.NewICEUDPMux(nil, udpListener)
+		e.settings.SetICEUDPMux(udpMux)
+		e.udpMux = closers{udpMux, udpListener}
+	} else {
+		var icePortStart, icePortEnd uint16
+
+		if len(c.WebRTC.ICEPortRange) == 2 {
+			icePortStart = c.WebRTC.ICEPortRange[0]
+			icePortEnd = c.WebRTC.ICEPortRange[1]
+		}
+		if icePortStart != 0 || icePortEnd != 0 {
+			if err := e.settings.SetEphemeralUDPPortRange(icePortStart, icePortEnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.WebRTC.Candidates.IceLite {
+		e.settings.SetLite(c.WebRTC.Candidates.IceLite)
+		e.iceLite = true
+	}
+
+	e.iceServers = c.WebRTC.ICEServers
+
+	if len(c.WebRTC.Candidates.NAT1To1IPs) > 0 {
+		e.settings.SetNAT1To1IPs(c.WebRTC.Candidates.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	return e, nil
+}
+
+// ICEServers returns the configured STUN/TURN servers, minting fresh credentials
+// for those using a shared secret. They are advertised to clients even in ice-lite
+// mode, where the engine itself does not use them.
+func (e *Engine) ICEServers() []webrtc.ICEServer {
+	var iceServers []webrtc.ICEServer
+	for _, iceServer := range e.iceServers {
+		s := webrtc.ICEServer{
+			URLs:       iceServer.URLs,
+			Username:   iceServer.Username,
+			Credential: iceServer.Credential,
+		}
+		if iceServer.Secret != "" {
+			ttl := time.Duration(iceServer.TTL) * time.Second
+			if ttl <= 0 {
+				ttl = defaultTURNCredentialTTL
+			}
+			s.Username, s.Credential = turnCredentials(iceServer.Secret, iceServer.Username, ttl)
+		}
+		iceServers = append(iceServers, s)
+	}
+	return iceServers
+}
+
+// turnCredentials mints a time-limited credential as described by the TURN REST API
+// draft: the username is "<expiry unix time>:<user>" and the password is the base64
+// encoded HMAC-SHA1 of the username keyed with the shared secret.
+func turnCredentials(secret, user string, ttl time.Duration) (string, string) {
+	if user == "" {
+		user = util.RandomString(8)
+	}
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Close releases the sockets owned by the engine. WHIPConns created by the
+// engine should be closed first.
+func (e *Engine) Close() error {
+	if e.udpMux == nil {
+		return nil
+	}
+	return e.udpMux.Close()
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var firstErr error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
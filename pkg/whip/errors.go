@@ -0,0 +1,18 @@
+package whip
+
+import "errors"
+
+var (
+	// ErrStreamExists is returned when publishing to a stream that already has a publisher
+	ErrStreamExists = errors.New("stream already has a publisher")
+	// ErrNoPublisher is returned when subscribing to a stream without publisher
+	ErrNoPublisher = errors.New("stream has no publisher")
+	// ErrBadOffer is returned for an offer that is not a valid session description
+	ErrBadOffer = errors.New("invalid offer")
+	// ErrUnsupportedCodec is returned for an offer with a media section without any supported codec
+	ErrUnsupportedCodec = errors.New("no supported codec")
+	// ErrTrackNotFound is returned when removing a track that is not sent
+	ErrTrackNotFound = errors.New("track not found")
+	// ErrCodecMismatch is returned when replacing the source of a FanoutTrack by a track of another codec
+	ErrCodecMismatch = errors.New("codec does not match the track")
+)
@@ -0,0 +1,371 @@
+package whip
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// retransmitBufferSize is the number of packets of a FanoutTrack kept to answer NACKs
+	retransmitBufferSize = 1024
+	// feedbackInterval is the minimum interval of the feedback sent to a publisher
+	feedbackInterval = time.Second
+	// feedbackTimeout is the age after which the reports of a player are ignored
+	feedbackTimeout = 5 * time.Second
+)
+
+// FanoutTrack is a TrackLocal forwarding the packets of a received track to the
+// WHEPConns it is added to. It answers the NACKs of the players from a single
+// retransmission buffer, and feeds the worst loss and the lowest bitrate estimate
+// reported by the players back to the publisher. Its source can be replaced
+// without the players noticing, see SetSource.
+type FanoutTrack struct {
+	codec        webrtc.RTPCodecCapability
+	kind         webrtc.RTPCodecType
+	id, streamID string
+
+	lock         sync.Mutex
+	conn         *WHIPConn
+	source       *webrtc.TrackRemote
+	ssrc         uint32
+	bindings     map[uint32]*fanoutBinding
+	buffer       [retransmitBufferSize]bufferedPacket
+	lastFeedback time.Time
+
+	// the packets of the source are rewritten to continue those sent before
+	// a replacement, resync is set until the first packet of a new source
+	resync        bool
+	started       bool
+	seqOffset     uint16
+	tsOffset      uint32
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastWritten   time.Time
+}
+
+// fanoutBinding is the stream of a FanoutTrack sent to a player
+type fanoutBinding struct {
+	ssrc        uint32
+	payloadType uint8
+	writer      webrtc.TrackLocalWriter
+
+	fractionLost uint8
+	reported     time.Time
+	bitrate      float32
+	estimated    time.Time
+}
+
+type bufferedPacket struct {
+	valid   bool
+	header  rtp.Header
+	payload []byte
+}
+
+// NewFanoutTrack creates a FanoutTrack forwarding the packets of source, a track received by conn
+func NewFanoutTrack(conn *WHIPConn, source *webrtc.TrackRemote) *FanoutTrack {
+	return &FanoutTrack{
+		codec:    source.Codec().RTPCodecCapability,
+		kind:     source.Kind(),
+		id:       source.ID(),
+		streamID: source.StreamID(),
+		conn:     conn,
+		source:   source,
+		ssrc:     uint32(source.SSRC()),
+		bindings: make(map[uint32]*fanoutBinding),
+	}
+}
+
+// SetSource replaces the forwarded track by source, a track of the same codec,
+// e.g. of a new publisher of the stream. The players keep receiving the same
+// stream: the packets of source are sent from its first keyframe, which is
+// requested, with sequence numbers and timestamps following those already sent.
+// The packets of the previous source are dropped from then on.
+func (f *FanoutTrack) SetSource(conn *WHIPConn, source *webrtc.TrackRemote) error {
+	if mimeType := source.Codec().MimeType; !strings.EqualFold(mimeType, f.codec.MimeType) {
+		return fmt.Errorf("%w: %v instead of %v", ErrCodecMismatch, mimeType, f.codec.MimeType)
+	}
+
+	f.lock.Lock()
+	f.conn = conn
+	f.source = source
+	f.ssrc = uint32(source.SSRC())
+	f.resync = true
+	f.lock.Unlock()
+
+	f.RequestKeyframe()
+	return nil
+}
+
+// RequestKeyframe asks the publisher of the source for a keyframe, see WHIPConn.RequestKeyframe
+func (f *FanoutTrack) RequestKeyframe() {
+	f.lock.Lock()
+	conn, source := f.conn, f.source
+	f.lock.Unlock()
+	conn.RequestKeyframe(source)
+}
+
+// Bind is called by the PeerConnection once the codecs are negotiated
+func (f *FanoutTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(f.codec, t.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	f.lock.Lock()
+	f.bindings[uint32(t.SSRC())] = &fanoutBinding{
+		ssrc:        uint32(t.SSRC()),
+		payloadType: uint8(codec.PayloadType),
+		writer:      t.WriteStream(),
+	}
+	f.lock.Unlock()
+	return codec, nil
+}
+
+// matchCodec finds the codec of capability in the negotiated codecs, by mime type and fmtp
+// or else by mime type only
+func matchCodec(capability webrtc.RTPCodecCapability, codecs []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, codec := range codecs {
+		if strings.EqualFold(codec.MimeType, capability.MimeType) && codec.SDPFmtpLine == capability.SDPFmtpLine {
+			return codec, true
+		}
+	}
+	for _, codec := range codecs {
+		if strings.EqualFold(codec.MimeType, capability.MimeType) {
+			return codec, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// Unbind is called by the PeerConnection when the track is no longer sent
+func (f *FanoutTrack) Unbind(t webrtc.TrackLocalContext) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, found := f.bindings[uint32(t.SSRC())]; !found {
+		return webrtc.ErrUnbindFailed
+	}
+	delete(f.bindings, uint32(t.SSRC()))
+	return nil
+}
+
+// ID is the id of the source track
+func (f *FanoutTrack) ID() string { return f.id }
+
+// StreamID is the stream id of the source track
+func (f *FanoutTrack) StreamID() string { return f.streamID }
+
+// Kind is the kind of the source track
+func (f *FanoutTrack) Kind() webrtc.RTPCodecType { return f.kind }
+
+// Codec is the codec of the source track
+func (f *FanoutTrack) Codec() webrtc.RTPCodecCapability { return f.codec }
+
+// Source is the received track forwarded
+func (f *FanoutTrack) Source() *webrtc.TrackRemote {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.source
+}
+
+// WriteRTP sends a packet of the source track to all the players, the packets of
+// a replaced source are dropped. The header extensions are sent as is, their ids
+// are those negotiated with the publisher.
+func (f *FanoutTrack) WriteRTP(p *rtp.Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if p.SSRC != f.ssrc {
+		return nil
+	}
+	now := time.Now()
+	if f.resync {
+		// a player can only decode the new source from a keyframe
+		if f.kind == webrtc.RTPCodecTypeVideo && !isKeyframe(f.codec.MimeType, p.Payload) {
+			return nil
+		}
+		if f.started {
+			elapsed := uint32(now.Sub(f.lastWritten).Seconds() * float64(f.codec.ClockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			f.seqOffset = f.lastSeq + 1 - p.SequenceNumber
+			f.tsOffset = f.lastTimestamp + elapsed - p.Timestamp
+		}
+		f.resync = false
+	}
+
+	slot := &f.buffer[(p.SequenceNumber+f.seqOffset)%retransmitBufferSize]
+	slot.valid = true
+	slot.header = p.Header
+	slot.header.SequenceNumber += f.seqOffset
+	slot.header.Timestamp += f.tsOffset
+	slot.payload = append(slot.payload[:0], p.Payload...)
+
+	if !f.started || int16(slot.header.SequenceNumber-f.lastSeq) > 0 {
+		f.lastSeq = slot.header.SequenceNumber
+		f.lastTimestamp = slot.header.Timestamp
+		f.lastWritten = now
+	}
+	f.started = true
+
+	var err error
+	for _, b := range f.bindings {
+		if writeErr := b.write(&slot.header, slot.payload); writeErr != nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+func (b *fanoutBinding) write(header *rtp.Header, payload []byte) error {
+	h := *header
+	h.SSRC = b.ssrc
+	h.PayloadType = b.payloadType
+	_, err := b.writer.WriteRTP(&h, payload)
+	return err
+}
+
+// handleRTCP handles the feedback of a player about the track
+func (f *FanoutTrack) handleRTCP(pkts []rtcp.Packet) {
+	now := time.Now()
+
+	f.lock.Lock()
+	for _, pkt := range pkts {
+		switch pkt := pkt.(type) {
+		case *rtcp.TransportLayerNack:
+			if b := f.bindings[pkt.MediaSSRC]; b != nil {
+				for i := range pkt.Nacks {
+					pkt.Nacks[i].Range(func(seq uint16) bool {
+						f.retransmit(b, seq)
+						return true
+					})
+				}
+			}
+		case *rtcp.ReceiverReport:
+			for _, report := range pkt.Reports {
+				if b := f.bindings[report.SSRC]; b != nil {
+					b.fractionLost = report.FractionLost
+					b.reported = now
+				}
+			}
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			for _, ssrc := range pkt.SSRCs {
+				if b := f.bindings[ssrc]; b != nil {
+					b.bitrate = pkt.Bitrate
+					b.estimated = now
+				}
+			}
+		}
+	}
+
+	if now.Sub(f.lastFeedback) < feedbackInterval {
+		f.lock.Unlock()
+		return
+	}
+	f.lastFeedback = now
+	fractionLost, bitrate := f.aggregate(now)
+	conn, ssrc := f.conn, f.ssrc
+	f.lock.Unlock()
+
+	conn.sendFeedback(ssrc, fractionLost, bitrate)
+}
+
+// retransmit resends a buffered packet to a player, the packets no longer
+// buffered are lost for the player
+func (f *FanoutTrack) retransmit(b *fanoutBinding, seq uint16) {
+	slot := &f.buffer[seq%retransmitBufferSize]
+	if !slot.valid || slot.header.SequenceNumber != seq {
+		return
+	}
+	if err := b.write(&slot.header, slot.payload); err != nil {
+		log.Printf("retransmit %d to ssrc %d: %v", seq, b.ssrc, err)
+	}
+}
+
+// aggregate returns the worst loss and the lowest bitrate estimate of the players
+// that reported them recently, the bitrate is 0 without estimate
+func (f *FanoutTrack) aggregate(now time.Time) (uint8, float32) {
+	var fractionLost uint8
+	var bitrate float32
+	for _, b := range f.bindings {
+		if now.Sub(b.reported) < feedbackTimeout && b.fractionLost > fractionLost {
+			fractionLost = b.fractionLost
+		}
+		if now.Sub(b.estimated) < feedbackTimeout && (bitrate == 0 || b.bitrate < bitrate) {
+			bitrate = b.bitrate
+		}
+	}
+	return fractionLost, bitrate
+}
+
+// sendFeedback reports the players of a received track to the publisher: the
+// receiver reports about the track carry at least their loss, and a REMB
+// limits the bitrate to their lowest estimate
+func (w *WHIPConn) sendFeedback(ssrc uint32, fractionLost uint8, bitrate float32) {
+	w.downstreamLoss.set(ssrc, fractionLost)
+	if bitrate <= 0 {
+		return
+	}
+	if err := w.pc.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate, SSRCs: []uint32{ssrc}}}); err != nil {
+		log.Printf("remb for ssrc %d: %v", ssrc, err)
+	}
+}
+
+// lossInterceptor raises the fraction lost of the receiver reports sent by a
+// connection to the loss of the players of the tracks it receives
+type lossInterceptor struct {
+	interceptor.NoOp
+	lock   sync.Mutex
+	losses map[uint32]downstreamLoss
+}
+
+type downstreamLoss struct {
+	fractionLost uint8
+	updated      time.Time
+}
+
+func newLossInterceptor() *lossInterceptor {
+	return &lossInterceptor{losses: make(map[uint32]downstreamLoss)}
+}
+
+// NewInterceptor implements interceptor.Factory, there is one lossInterceptor per connection
+func (i *lossInterceptor) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *lossInterceptor) set(ssrc uint32, fractionLost uint8) {
+	i.lock.Lock()
+	i.losses[ssrc] = downstreamLoss{fractionLost: fractionLost, updated: time.Now()}
+	i.lock.Unlock()
+}
+
+// BindRTCPWriter rewrites the receiver reports
+func (i *lossInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		now := time.Now()
+		i.lock.Lock()
+		for _, pkt := range pkts {
+			rr, ok := pkt.(*rtcp.ReceiverReport)
+			if !ok {
+				continue
+			}
+			for j := range rr.Reports {
+				loss, found := i.losses[rr.Reports[j].SSRC]
+				if found && now.Sub(loss.updated) < feedbackTimeout && loss.fractionLost > rr.Reports[j].FractionLost {
+					rr.Reports[j].FractionLost = loss.fractionLost
+				}
+			}
+		}
+		i.lock.Unlock()
+		return writer.Write(pkts, a)
+	})
+}
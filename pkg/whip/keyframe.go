@@ -0,0 +1,306 @@
+package whip
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	// keyframeInterval is the minimum interval between two keyframe requests of a track
+	keyframeInterval = 500 * time.Millisecond
+	// keyframeTimeout is the time a keyframe is waited for before the request is repeated
+	keyframeTimeout = time.Second
+	// pliAttempts is the number of unanswered PLIs after which a FIR is sent, when negotiated
+	pliAttempts = 2
+	// keyframeAttempts is the number of unanswered requests after which a request is dropped
+	keyframeAttempts = 5
+)
+
+// keyframeInterceptor requests the keyframes of the received video tracks on demand.
+// It watches the received packets for keyframes and writes its requests to the
+// RTCP writer of the connection.
+type keyframeInterceptor struct {
+	interceptor.NoOp
+	lock       sync.Mutex
+	writer     interceptor.RTCPWriter
+	keyframers map[uint32]*keyframer
+}
+
+func newKeyframeInterceptor() *keyframeInterceptor {
+	return &keyframeInterceptor{keyframers: make(map[uint32]*keyframer)}
+}
+
+// NewInterceptor implements interceptor.Factory, there is one keyframeInterceptor per connection
+func (i *keyframeInterceptor) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+// BindRTCPWriter keeps the writer of the keyframe requests
+func (i *keyframeInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	i.lock.Lock()
+	i.writer = writer
+	i.lock.Unlock()
+	return writer
+}
+
+func (i *keyframeInterceptor) write(pkts []rtcp.Packet) error {
+	i.lock.Lock()
+	writer := i.writer
+	i.lock.Unlock()
+	_, err := writer.Write(pkts, interceptor.Attributes{})
+	return err
+}
+
+// BindRemoteStream watches the keyframes of a received video track
+func (i *keyframeInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return reader
+	}
+
+	k := &keyframer{ssrc: info.SSRC, write: i.write}
+	for _, feedback := range info.RTCPFeedback {
+		if feedback.Type == "ccm" && feedback.Parameter == "fir" {
+			k.fir = true
+		}
+	}
+	i.lock.Lock()
+	i.keyframers[info.SSRC] = k
+	i.lock.Unlock()
+
+	mimeType := info.MimeType
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		header := &rtp.Header{}
+		if hn, err := header.Unmarshal(b[:n]); err == nil && isKeyframe(mimeType, b[hn:n]) {
+			k.onKeyframe()
+		}
+		return n, attr, nil
+	})
+}
+
+// UnbindRemoteStream stops the requests of a track that ended
+func (i *keyframeInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.lock.Lock()
+	k := i.keyframers[info.SSRC]
+	delete(i.keyframers, info.SSRC)
+	i.lock.Unlock()
+	if k != nil {
+		k.close()
+	}
+}
+
+// Close stops the requests of all the tracks
+func (i *keyframeInterceptor) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for ssrc, k := range i.keyframers {
+		k.close()
+		delete(i.keyframers, ssrc)
+	}
+	return nil
+}
+
+// request asks for a keyframe of the track with ssrc
+func (i *keyframeInterceptor) request(ssrc uint32) {
+	i.lock.Lock()
+	k := i.keyframers[ssrc]
+	i.lock.Unlock()
+	if k != nil {
+		k.request()
+	}
+}
+
+// keyframer requests the keyframes of a track. A request is pending until a
+// keyframe arrives, the requests made meanwhile are coalesced with it.
+type keyframer struct {
+	ssrc  uint32
+	fir   bool
+	write func([]rtcp.Packet) error
+
+	lock     sync.Mutex
+	pending  bool
+	attempts int
+	last     time.Time
+	firSeq   uint8
+	timer    *time.Timer
+	closed   bool
+}
+
+func (k *keyframer) request() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed || k.pending {
+		return
+	}
+	k.pending = true
+	k.attempts = 0
+	if wait := keyframeInterval - time.Since(k.last); wait > 0 {
+		k.schedule(wait)
+		return
+	}
+	k.send()
+}
+
+func (k *keyframer) schedule(d time.Duration) {
+	if k.timer != nil {
+		k.timer.Stop()
+	}
+	k.timer = time.AfterFunc(d, k.retry)
+}
+
+func (k *keyframer) retry() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed || !k.pending {
+		return
+	}
+	if k.attempts >= keyframeAttempts {
+		log.Printf("no keyframe for ssrc %d after %d requests", k.ssrc, k.attempts)
+		k.pending = false
+		return
+	}
+	k.send()
+}
+
+// send sends a PLI, or a FIR once PLIs went unanswered, and schedules its retry
+func (k *keyframer) send() {
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: k.ssrc}
+	if k.fir && k.attempts >= pliAttempts {
+		k.firSeq++
+		pkt = &rtcp.FullIntraRequest{MediaSSRC: k.ssrc, FIR: []rtcp.FIREntry{{SSRC: k.ssrc, SequenceNumber: k.firSeq}}}
+	}
+	k.attempts++
+	k.last = time.Now()
+	if err := k.write([]rtcp.Packet{pkt}); err != nil {
+		log.Printf("keyframe request for ssrc %d: %v", k.ssrc, err)
+	}
+	k.schedule(keyframeTimeout)
+}
+
+func (k *keyframer) onKeyframe() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.pending {
+		k.pending = false
+		k.timer.Stop()
+	}
+}
+
+func (k *keyframer) close() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.closed = true
+	if k.timer != nil {
+		k.timer.Stop()
+	}
+}
+
+// isKeyframe reports whether an RTP payload of a video codec starts a keyframe
+func isKeyframe(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(mimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(mimeTypeVP9):
+		// not inter-picture predicted and start of a frame
+		return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	case strings.ToLower(mimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(mimeTypeH265):
+		return isH265Keyframe(payload)
+	case strings.ToLower(mimeTypeAV1):
+		// the N bit of the aggregation header starts a coded video sequence
+		return payload[0]&0x08 != 0
+	}
+	return false
+}
+
+// isVP8Keyframe parses the payload descriptor of RFC 7741 to read the P bit of the frame
+func isVP8Keyframe(payload []byte) bool {
+	// only the start of the first partition holds the frame header
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 {
+			// a 15 bits picture id has the M bit set
+			if len(payload) > i && payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 {
+			i++
+		}
+		if ext&0x30 != 0 {
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// isH264Keyframe looks for an IDR slice or a sequence parameter set, also in
+// STAP-A aggregation packets and at the start of FU-A fragmented units
+func isH264Keyframe(payload []byte) bool {
+	isKey := func(typ byte) bool { return typ == 5 || typ == 7 }
+	switch typ := payload[0] & 0x1f; typ {
+	case 24:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isKey(payload[i+2] & 0x1f) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case 28:
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKey(payload[1]&0x1f)
+	default:
+		return isKey(typ)
+	}
+}
+
+// isH265Keyframe looks for an IRAP picture or a video parameter set, also in
+// aggregation packets and at the start of fragmentation units
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	isKey := func(typ byte) bool { return (typ >= 16 && typ <= 21) || typ == 32 }
+	switch typ := payload[0] >> 1 & 0x3f; typ {
+	case 48:
+		for i := 2; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isKey(payload[i+2] >> 1 & 0x3f) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case 49:
+		return len(payload) > 2 && payload[2]&0x80 != 0 && isKey(payload[2]&0x3f)
+	default:
+		return isKey(typ)
+	}
+}
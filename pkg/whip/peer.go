@@ -0,0 +1,358 @@
+package whip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/webrtc/v3"
+)
+
+// peer holds the PeerConnection handling shared by WHIPConn and WHEPConn
+type peer struct {
+	pc                      *webrtc.PeerConnection
+	OnConnectionStateChange func(s webrtc.PeerConnectionState)
+	// OnSelectedCandidatePairChange is called when ICE selects a candidate pair
+	OnSelectedCandidatePairChange func(pair *webrtc.ICECandidatePair)
+	iceServers                    []webrtc.ICEServer
+	gatherTimeout                 time.Duration
+	// maxBitrate, when set, is announced in the answer as the video bitrate to send
+	maxBitrate int
+	codecs     *codecSet
+
+	// onConnected is called each time the connection gets connected
+	onConnected func()
+
+	statsInterceptor *statsInterceptor
+	keyframes        *keyframeInterceptor
+	downstreamLoss   *lossInterceptor
+	pairLock         sync.Mutex
+	selectedPair     *webrtc.ICECandidatePair
+
+	// local candidates gathered after the description was returned, to be trickled
+	candidateLock     sync.Mutex
+	pending           []webrtc.ICECandidateInit
+	sent              map[string]bool
+	gatheringComplete bool
+	endSent           bool
+}
+
+// newPeer creates a PeerConnection with the engine settings, using codecs instead
+// of the engine codecs when given. Without nackResponder the NACKs are left to
+// the tracks, e.g. FanoutTrack.
+func (e *Engine) newPeer(codecs []CodecConfig, nackResponder bool) (*peer, error) {
+	codecSet := e.codecs
+	if len(codecs) > 0 {
+		var err error
+		if codecSet, err = newCodecSet(codecs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create a MediaEngine object to configure the supported codec
+	m := &webrtc.MediaEngine{}
+	if err := codecSet.register(m); err != nil {
+		return nil, err
+	}
+
+	// Enable the header extensions needed to receive RID based simulcast
+	if err := registerSimulcastExtensions(m); err != nil {
+		return nil, err
+	}
+
+	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
+	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
+	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
+	// for each PeerConnection.
+	i := &interceptor.Registry{}
+
+	// The stats come first to see the feedback generated by the default interceptors
+	stats := newStatsInterceptor()
+	i.Add(stats)
+	keyframes := newKeyframeInterceptor()
+	i.Add(keyframes)
+	// before the receiver reports it rewrites
+	downstreamLoss := newLossInterceptor()
+	i.Add(downstreamLoss)
+
+	if err := registerDefaultInterceptors(m, i, nackResponder); err != nil {
+		return nil, err
+	}
+
+	// Create the API object with the MediaEngine
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(e.settings), webrtc.WithInterceptorRegistry(i))
+
+	iceServers := e.ICEServers()
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+		//RTCPMuxPolicy: webrtc.RTCPMuxPolicyRequire,
+		BundlePolicy: webrtc.BundlePolicyBalanced,
+	}
+	// An ice-lite agent only has host candidates, the ice servers are for the remote peer
+	if !e.iceLite {
+		config.ICEServers = iceServers
+	}
+
+	// Create a new RTCPeerConnection
+	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &peer{
+		pc:               peerConnection,
+		iceServers:       iceServers,
+		gatherTimeout:    e.gatherTimeout,
+		statsInterceptor: stats,
+		keyframes:        keyframes,
+		downstreamLoss:   downstreamLoss,
+		codecs:           codecSet,
+		sent:             make(map[string]bool),
+	}
+
+	peerConnection.OnICECandidate(p.onICECandidate)
+	peerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		log.Printf("Selected candidate pair: %s\n", pair)
+		p.pairLock.Lock()
+		p.selectedPair = pair
+		p.pairLock.Unlock()
+		if p.OnSelectedCandidatePairChange != nil {
+			go p.OnSelectedCandidatePairChange(pair)
+		}
+	})
+
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		log.Printf("Peer Connection State has changed: %s\n", s.String())
+		if s == webrtc.PeerConnectionStateConnected && p.onConnected != nil {
+			go p.onConnected()
+		}
+		if p.OnConnectionStateChange != nil {
+			go p.OnConnectionStateChange(s)
+		}
+	})
+
+	return p, nil
+}
+
+// registerDefaultInterceptors registers the interceptors of webrtc.RegisterDefaultInterceptors,
+// the NACK responder only with nackResponder
+func registerDefaultInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry, nackResponder bool) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	if nackResponder {
+		responder, err := nack.NewResponderInterceptor()
+		if err != nil {
+			return err
+		}
+		i.Add(responder)
+	}
+	i.Add(generator)
+
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// ICEServers returns the STUN/TURN servers used by the connection,
+// to be advertised to the remote peer
+func (p *peer) ICEServers() []webrtc.ICEServer {
+	return p.iceServers
+}
+
+// GetStats returns the stats report of the PeerConnection
+func (p *peer) GetStats() webrtc.StatsReport {
+	return p.pc.GetStats()
+}
+
+// gatherContext bounds ICE gathering with the gather timeout of the engine
+func (p *peer) gatherContext() (context.Context, context.CancelFunc) {
+	if p.gatherTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.gatherTimeout)
+}
+
+// answer answers a remote offer once ICE gathering is complete or ctx is done
+func (p *peer) answer(ctx context.Context, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := p.codecs.checkOffer(offer.SDP); err != nil {
+		p.pc.Close()
+		return nil, err
+	}
+
+	// Set the remote SessionDescription
+	err := p.pc.SetRemoteDescription(offer)
+	if err != nil {
+		log.Printf("SetRemoteDescription err %v ", err)
+		p.pc.Close()
+		return nil, fmt.Errorf("%w: %v", ErrBadOffer, err)
+	}
+
+	// Create an answer
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("CreateAnswer err %v ", err)
+		p.pc.Close()
+		return nil, err
+	}
+
+	local, err := p.setLocalDescription(ctx, answer)
+	if err != nil || p.maxBitrate <= 0 {
+		return local, err
+	}
+	// pion rejects a modified answer, so the limit is only added to the sent copy
+	limited := *local
+	limited.SDP = limitVideoBitrate(local.SDP, p.maxBitrate)
+	return &limited, nil
+}
+
+// setLocalDescription sets the local description and waits for ICE gathering to
+// complete or ctx to be done. The returned description holds the candidates
+// gathered so far, the later ones are returned by PendingCandidates.
+func (p *peer) setLocalDescription(ctx context.Context, desc webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	local, err := p.gather(ctx, desc)
+	if err != nil {
+		p.pc.Close()
+	}
+	return local, err
+}
+
+// gather is setLocalDescription leaving the connection open on failure
+func (p *peer) gather(ctx context.Context, desc webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(p.pc)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		log.Printf("SetLocalDescription err %v ", err)
+		return nil, err
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		log.Printf("answering before ICE gathering completes: %v", ctx.Err())
+	}
+
+	local := p.pc.LocalDescription()
+	p.markSent(local)
+	return local, nil
+}
+
+// limitVideoBitrate adds b=AS, in kilobits per second, to the video media sections
+// of sdp, after their c= line. b=TIAS is not understood by the pion sdp parser.
+func limitVideoBitrate(sdp string, bitrate int) string {
+	var b strings.Builder
+	video := false
+	for _, line := range strings.SplitAfter(sdp, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(trimmed, "m="):
+			video = strings.HasPrefix(trimmed, "m=video")
+		case strings.HasPrefix(trimmed, "b="):
+			if video {
+				// replaced by the limit
+				continue
+			}
+		}
+		b.WriteString(line)
+		if video && strings.HasPrefix(trimmed, "c=") {
+			b.WriteString("b=AS:" + strconv.Itoa((bitrate+999)/1000) + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+func (p *peer) onICECandidate(candidate *webrtc.ICECandidate) {
+	p.candidateLock.Lock()
+	defer p.candidateLock.Unlock()
+
+	if candidate == nil {
+		p.gatheringComplete = true
+		return
+	}
+	init := candidate.ToJSON()
+	if !p.sent[init.Candidate] {
+		p.pending = append(p.pending, init)
+	}
+}
+
+// markSent drops the pending candidates held by desc
+func (p *peer) markSent(desc *webrtc.SessionDescription) {
+	session := parseICESession(desc.SDP)
+
+	p.candidateLock.Lock()
+	defer p.candidateLock.Unlock()
+
+	for _, candidate := range session.candidates {
+		p.sent[candidate.Candidate] = true
+	}
+	pending := p.pending[:0]
+	for _, candidate := range p.pending {
+		if !p.sent[candidate.Candidate] {
+			pending = append(pending, candidate)
+		}
+	}
+	p.pending = pending
+	p.endSent = session.endOfCandidates
+}
+
+// resetCandidates forgets the candidates of the previous ICE session
+func (p *peer) resetCandidates() {
+	p.candidateLock.Lock()
+	defer p.candidateLock.Unlock()
+
+	p.pending = nil
+	p.sent = make(map[string]bool)
+	p.gatheringComplete = false
+	p.endSent = false
+}
+
+// PendingCandidates returns the sdpfrag of the local candidates gathered since
+// the description was returned or PendingCandidates was last called, and the
+// end of gathering. It returns nil when there is nothing new to trickle.
+func (p *peer) PendingCandidates() *SDPFrag {
+	local := p.pc.LocalDescription()
+	if local == nil {
+		return nil
+	}
+
+	p.candidateLock.Lock()
+	defer p.candidateLock.Unlock()
+
+	ended := p.gatheringComplete && !p.endSent
+	if len(p.pending) == 0 && !ended {
+		return nil
+	}
+	frag := NewSDPFrag(*local, p.pending, ended)
+	for _, candidate := range p.pending {
+		p.sent[candidate.Candidate] = true
+	}
+	p.pending = nil
+	p.endSent = p.gatheringComplete
+	return frag
+}
+
+func (p *peer) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	return p.pc.AddICECandidate(candidate)
+}
+
+func (p *peer) Close() {
+	if p.pc != nil && p.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		if cErr := p.pc.Close(); cErr != nil {
+			log.Printf("cannot close peerConnection: %v\n", cErr)
+		}
+	}
+}
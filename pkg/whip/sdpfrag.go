@@ -0,0 +1,407 @@
+package whip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SDPFragContentType is the media type of the PATCH bodies trickling candidates
+const SDPFragContentType = "application/trickle-ice-sdpfrag"
+
+var (
+	// ErrICEUfragMismatch is returned when an sdpfrag is for another ICE session
+	ErrICEUfragMismatch = errors.New("ice-ufrag does not match the ice session")
+	// ErrUnknownMid is returned when an sdpfrag refers to a media section missing from the session
+	ErrUnknownMid = errors.New("mid not found in the session")
+	// ErrICERestartUnsupported is returned when ICE is restarted on a connection that made the offer
+	ErrICERestartUnsupported = errors.New("ice restart is only supported on answered offers")
+)
+
+// SDPFrag is an application/trickle-ice-sdpfrag body as defined by RFC 8840.
+// The ice-ufrag and ice-pwd may be given for the session or per media section.
+type SDPFrag struct {
+	ICEUfrag        string
+	ICEPwd          string
+	EndOfCandidates bool
+	Media           []SDPFragMedia
+}
+
+// SDPFragMedia is a media section of an sdpfrag, identified by its mid.
+// Candidates hold the attribute values, e.g. "candidate:1 1 udp ...".
+type SDPFragMedia struct {
+	Mid             string
+	ICEUfrag        string
+	ICEPwd          string
+	Candidates      []string
+	EndOfCandidates bool
+}
+
+// ParseSDPFrag parses an application/trickle-ice-sdpfrag body
+func ParseSDPFrag(frag string) (*SDPFrag, error) {
+	f := &SDPFrag{}
+	var media *SDPFragMedia
+
+	for n, line := range strings.Split(frag, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, fmt.Errorf("sdpfrag line %d: invalid line %q", n+1, line)
+		}
+
+		switch line[0] {
+		case 'm':
+			if media != nil && media.Mid == "" {
+				return nil, fmt.Errorf("sdpfrag line %d: media section without mid", n+1)
+			}
+			f.Media = append(f.Media, SDPFragMedia{})
+			media = &f.Media[len(f.Media)-1]
+			continue
+		case 'a':
+		default:
+			// other session description lines carry nothing for ice
+			continue
+		}
+
+		attr := line[2:]
+		key, value := attr, ""
+		if i := strings.IndexByte(attr, ':'); i >= 0 {
+			key, value = attr[:i], attr[i+1:]
+		}
+
+		switch key {
+		case "ice-ufrag":
+			if media != nil {
+				media.ICEUfrag = value
+			} else {
+				f.ICEUfrag = value
+			}
+		case "ice-pwd":
+			if media != nil {
+				media.ICEPwd = value
+			} else {
+				f.ICEPwd = value
+			}
+		case "mid":
+			if media == nil {
+				return nil, fmt.Errorf("sdpfrag line %d: mid outside of a media section", n+1)
+			}
+			media.Mid = value
+		case "candidate":
+			if media == nil {
+				return nil, fmt.Errorf("sdpfrag line %d: candidate outside of a media section", n+1)
+			}
+			if value == "" {
+				return nil, fmt.Errorf("sdpfrag line %d: empty candidate", n+1)
+			}
+			media.Candidates = append(media.Candidates, attr)
+		case "end-of-candidates":
+			if media != nil {
+				media.EndOfCandidates = true
+			} else {
+				f.EndOfCandidates = true
+			}
+		}
+	}
+	if media != nil && media.Mid == "" {
+		return nil, errors.New("sdpfrag: media section without mid")
+	}
+	return f, nil
+}
+
+// String marshals the sdpfrag, each media section as the "m=audio 9 RTP/AVP 0"
+// placeholder of RFC 8840
+func (f *SDPFrag) String() string {
+	var b strings.Builder
+	writeAttr := func(key, value string) {
+		if value != "" {
+			b.WriteString("a=" + key + ":" + value + "\r\n")
+		}
+	}
+
+	writeAttr("ice-ufrag", f.ICEUfrag)
+	writeAttr("ice-pwd", f.ICEPwd)
+	if f.EndOfCandidates {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	for _, media := range f.Media {
+		b.WriteString("m=audio 9 RTP/AVP 0\r\n")
+		writeAttr("mid", media.Mid)
+		writeAttr("ice-ufrag", media.ICEUfrag)
+		writeAttr("ice-pwd", media.ICEPwd)
+		for _, candidate := range media.Candidates {
+			b.WriteString("a=" + candidate + "\r\n")
+		}
+		if media.EndOfCandidates {
+			b.WriteString("a=end-of-candidates\r\n")
+		}
+	}
+	return b.String()
+}
+
+// NewSDPFrag builds the sdpfrag trickling candidates gathered for desc, with
+// the ice credentials of desc. Candidates without a mid, as gathered by pion,
+// go to the first media section, which carries the transport of a bundle.
+func NewSDPFrag(desc webrtc.SessionDescription, candidates []webrtc.ICECandidateInit, ended bool) *SDPFrag {
+	session := parseICESession(desc.SDP)
+	f := &SDPFrag{
+		ICEUfrag: session.ufrag,
+		ICEPwd:   session.pwd,
+	}
+
+	media := func(mid string) *SDPFragMedia {
+		for i := range f.Media {
+			if f.Media[i].Mid == mid {
+				return &f.Media[i]
+			}
+		}
+		f.Media = append(f.Media, SDPFragMedia{Mid: mid})
+		return &f.Media[len(f.Media)-1]
+	}
+
+	for _, candidate := range candidates {
+		mid := ""
+		if candidate.SDPMid != nil {
+			mid = *candidate.SDPMid
+		}
+		if mid == "" {
+			mid = session.firstMid
+		}
+		m := media(mid)
+		m.Candidates = append(m.Candidates, candidate.Candidate)
+	}
+	if ended {
+		media(session.firstMid).EndOfCandidates = true
+	}
+	return f
+}
+
+// DescriptionSDPFrag returns the sdpfrag of the ice credentials and of the
+// candidates held by desc, as sent when ICE is restarted
+func DescriptionSDPFrag(desc webrtc.SessionDescription) *SDPFrag {
+	return NewSDPFrag(desc, parseICESession(desc.SDP).candidates, true)
+}
+
+// ApplySDPFrag returns desc with the ice credentials and candidates of frag in
+// place of its own, to renegotiate the ICE session restarted by frag
+func ApplySDPFrag(desc webrtc.SessionDescription, frag *SDPFrag) webrtc.SessionDescription {
+	ufrag, pwd := frag.credentials()
+	var b strings.Builder
+	mid := ""
+	inMedia := false
+
+	endMedia := func() {
+		if !inMedia {
+			return
+		}
+		for _, media := range frag.Media {
+			if media.Mid != mid {
+				continue
+			}
+			for _, candidate := range media.Candidates {
+				b.WriteString("a=" + candidate + "\r\n")
+			}
+			if media.EndOfCandidates || frag.EndOfCandidates {
+				b.WriteString("a=end-of-candidates\r\n")
+			}
+		}
+	}
+
+	for _, line := range strings.Split(desc.SDP, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "", strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		case strings.HasPrefix(line, "m="):
+			endMedia()
+			inMedia = true
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		}
+		b.WriteString(line + "\r\n")
+	}
+	endMedia()
+
+	return webrtc.SessionDescription{Type: desc.Type, SDP: b.String()}
+}
+
+// iceSession holds the ice credentials and media sections of a session description
+type iceSession struct {
+	ufrag           string
+	pwd             string
+	firstMid        string
+	mids            map[string]uint16
+	candidates      []webrtc.ICECandidateInit
+	endOfCandidates bool
+}
+
+func parseICESession(sdp string) iceSession {
+	s := iceSession{mids: make(map[string]uint16)}
+	index := -1
+	mid := ""
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:") && index >= 0:
+			mid = strings.TrimPrefix(line, "a=mid:")
+			if len(s.mids) == 0 {
+				s.firstMid = mid
+			}
+			s.mids[mid] = uint16(index)
+		case line == "a=end-of-candidates":
+			s.endOfCandidates = true
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidateMid := mid
+			s.candidates = append(s.candidates, webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: &candidateMid})
+		case strings.HasPrefix(line, "a=ice-ufrag:") && s.ufrag == "":
+			s.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:") && s.pwd == "":
+			s.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		}
+	}
+	return s
+}
+
+// Trickle adds the remote candidates of an sdpfrag. The ice-ufrag of the
+// fragment, when given, has to be the one of the remote description and the
+// media sections have to be known by their mid.
+func (p *peer) Trickle(frag *SDPFrag) error {
+	remote := p.pc.RemoteDescription()
+	if remote == nil {
+		return webrtc.ErrNoRemoteDescription
+	}
+	session := parseICESession(remote.SDP)
+
+	for _, ufrag := range frag.ufrags() {
+		if ufrag != session.ufrag {
+			return ErrICEUfragMismatch
+		}
+	}
+
+	var candidates []webrtc.ICECandidateInit
+	for _, media := range frag.Media {
+		index, found := session.mids[media.Mid]
+		if !found {
+			return fmt.Errorf("%w: %q", ErrUnknownMid, media.Mid)
+		}
+		for _, candidate := range media.Candidates {
+			mid := media.Mid
+			lineIndex := index
+			candidates = append(candidates, webrtc.ICECandidateInit{Candidate: candidate, SDPMid: &mid, SDPMLineIndex: &lineIndex})
+		}
+	}
+
+	for _, candidate := range candidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsICERestart reports whether frag carries new ice credentials for the
+// remote peer, rather than candidates of the current ICE session
+func (p *peer) IsICERestart(frag *SDPFrag) bool {
+	ufrag, pwd := frag.credentials()
+	if ufrag == "" || pwd == "" {
+		return false
+	}
+	remote := p.pc.RemoteDescription()
+	return remote != nil && parseICESession(remote.SDP).ufrag != ufrag
+}
+
+// RestartICE restarts ICE with the credentials and candidates of frag, keeping
+// the media of the connection. It returns the sdpfrag of the new local ICE
+// session once its candidates are gathered.
+func (p *peer) RestartICE(frag *SDPFrag) (*SDPFrag, error) {
+	remote := p.pc.RemoteDescription()
+	if remote == nil {
+		return nil, webrtc.ErrNoRemoteDescription
+	}
+	if remote.Type != webrtc.SDPTypeOffer {
+		return nil, ErrICERestartUnsupported
+	}
+
+	ctx, cancel := p.gatherContext()
+	defer cancel()
+	local, err := p.restart(ctx, ApplySDPFrag(*remote, frag))
+	if err != nil {
+		return nil, err
+	}
+	return DescriptionSDPFrag(*local), nil
+}
+
+// restart answers the offer restarting ICE. Unlike answer, a failure leaves the
+// connection open with its previous descriptions.
+func (p *peer) restart(ctx context.Context, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := p.codecs.checkOffer(offer.SDP); err != nil {
+		return nil, err
+	}
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		p.rollback()
+		return nil, fmt.Errorf("%w: %v", ErrBadOffer, err)
+	}
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		p.rollback()
+		return nil, err
+	}
+
+	// candidates of the restarted session are all sent in the returned sdpfrag
+	p.resetCandidates()
+	local, err := p.gather(ctx, answer)
+	if err != nil {
+		p.rollback()
+		return nil, err
+	}
+	return local, nil
+}
+
+// rollback drops the remote offer of a failed restart
+func (p *peer) rollback() {
+	current := p.pc.CurrentRemoteDescription()
+	if p.pc.SignalingState() != webrtc.SignalingStateHaveRemoteOffer || current == nil {
+		return
+	}
+	// pion parses the sdp of a rollback, the current one is valid
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback, SDP: current.SDP}); err != nil {
+		log.Printf("rollback err %v ", err)
+	}
+}
+
+// credentials returns the ice credentials of the fragment, those of the first
+// media section when not given for the session
+func (f *SDPFrag) credentials() (string, string) {
+	if f.ICEUfrag != "" || len(f.Media) == 0 {
+		return f.ICEUfrag, f.ICEPwd
+	}
+	return f.Media[0].ICEUfrag, f.Media[0].ICEPwd
+}
+
+// ufrags returns the ice-ufrag attributes given in the fragment
+func (f *SDPFrag) ufrags() []string {
+	var ufrags []string
+	if f.ICEUfrag != "" {
+		ufrags = append(ufrags, f.ICEUfrag)
+	}
+	for _, media := range f.Media {
+		if media.ICEUfrag != "" {
+			ufrags = append(ufrags, media.ICEUfrag)
+		}
+	}
+	return ufrags
+}
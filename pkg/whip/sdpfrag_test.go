@@ -0,0 +1,379 @@
+package whip
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	hostCandidate  = "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host"
+	otherCandidate = "candidate:2 1 udp 2130706431 192.0.2.2 5002 typ host"
+)
+
+// twoMediaSDP is an offer bundling an audio and a video section
+const twoMediaSDP = "v=0\r\n" +
+	"o=- 1 1 IN IP4 0.0.0.0\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:oldufrag\r\n" +
+	"a=ice-pwd:oldpwdoldpwdoldpwdoldpwd\r\n" +
+	"a=candidate:9 1 udp 1 198.51.100.9 9 typ host\r\n" +
+	"a=end-of-candidates\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=ice-ufrag:oldufrag\r\n" +
+	"a=ice-pwd:oldpwdoldpwdoldpwdoldpwd\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n"
+
+func TestParseSDPFrag(t *testing.T) {
+	tests := []struct {
+		name string
+		frag string
+		want *SDPFrag
+		err  string
+	}{
+		{
+			name: "session credentials",
+			frag: "a=ice-ufrag:u\r\na=ice-pwd:p\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+			want: &SDPFrag{ICEUfrag: "u", ICEPwd: "p", Media: []SDPFragMedia{{Mid: "0", Candidates: []string{hostCandidate}}}},
+		},
+		{
+			name: "media credentials and end of candidates",
+			frag: "m=audio 9 RTP/AVP 0\na=mid:0\na=ice-ufrag:u\na=ice-pwd:p\na=end-of-candidates\n",
+			want: &SDPFrag{Media: []SDPFragMedia{{Mid: "0", ICEUfrag: "u", ICEPwd: "p", EndOfCandidates: true}}},
+		},
+		{
+			name: "multiple media sections",
+			frag: "a=ice-ufrag:u\r\n" +
+				"m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n" +
+				"m=audio 9 RTP/AVP 0\r\na=mid:1\r\na=" + otherCandidate + "\r\na=end-of-candidates\r\n",
+			want: &SDPFrag{ICEUfrag: "u", Media: []SDPFragMedia{
+				{Mid: "0", Candidates: []string{hostCandidate}},
+				{Mid: "1", Candidates: []string{otherCandidate}, EndOfCandidates: true},
+			}},
+		},
+		{
+			name: "session end of candidates",
+			frag: "a=end-of-candidates\r\n",
+			want: &SDPFrag{EndOfCandidates: true},
+		},
+		{
+			name: "other lines ignored",
+			frag: "v=0\r\ns=-\r\na=group:BUNDLE 0\r\n",
+			want: &SDPFrag{},
+		},
+		{
+			name: "invalid line",
+			frag: "a=ice-ufrag:u\r\ngarbage\r\n",
+			err:  "line 2: invalid line",
+		},
+		{
+			name: "truncated line",
+			frag: "a\r\n",
+			err:  "line 1: invalid line",
+		},
+		{
+			name: "media section without mid",
+			frag: "m=audio 9 RTP/AVP 0\r\na=" + hostCandidate + "\r\nm=audio 9 RTP/AVP 0\r\na=mid:1\r\n",
+			err:  "line 3: media section without mid",
+		},
+		{
+			name: "last media section without mid",
+			frag: "m=audio 9 RTP/AVP 0\r\na=" + hostCandidate + "\r\n",
+			err:  "media section without mid",
+		},
+		{
+			name: "mid outside of a media section",
+			frag: "a=mid:0\r\n",
+			err:  "line 1: mid outside of a media section",
+		},
+		{
+			name: "candidate outside of a media section",
+			frag: "a=" + hostCandidate + "\r\n",
+			err:  "line 1: candidate outside of a media section",
+		},
+		{
+			name: "empty candidate",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=candidate:\r\n",
+			err:  "line 3: empty candidate",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frag, err := ParseSDPFrag(test.frag)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(frag, test.want) {
+				t.Errorf("got %+v, want %+v", frag, test.want)
+			}
+		})
+	}
+}
+
+func TestSDPFragString(t *testing.T) {
+	frag := &SDPFrag{ICEUfrag: "u", ICEPwd: "p", Media: []SDPFragMedia{
+		{Mid: "0", Candidates: []string{hostCandidate}},
+		{Mid: "1", Candidates: []string{otherCandidate}, EndOfCandidates: true},
+	}}
+	parsed, err := ParseSDPFrag(frag.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, frag) {
+		t.Errorf("got %+v, want %+v", parsed, frag)
+	}
+}
+
+func TestApplySDPFrag(t *testing.T) {
+	tests := []struct {
+		name string
+		frag *SDPFrag
+		// candidates expected in each media section, by mid
+		candidates map[string][]string
+		ended      map[string]bool
+		ufrag, pwd string
+	}{
+		{
+			name: "session credentials",
+			frag: &SDPFrag{ICEUfrag: "newufrag", ICEPwd: "newpwd", Media: []SDPFragMedia{
+				{Mid: "0", Candidates: []string{hostCandidate}},
+			}},
+			candidates: map[string][]string{"0": {hostCandidate}},
+			ended:      map[string]bool{},
+			ufrag:      "newufrag",
+			pwd:        "newpwd",
+		},
+		{
+			name: "media credentials",
+			frag: &SDPFrag{Media: []SDPFragMedia{
+				{Mid: "0", ICEUfrag: "mediaufrag", ICEPwd: "mediapwd"},
+			}},
+			candidates: map[string][]string{},
+			ended:      map[string]bool{},
+			ufrag:      "mediaufrag",
+			pwd:        "mediapwd",
+		},
+		{
+			name: "multiple media sections",
+			frag: &SDPFrag{ICEUfrag: "newufrag", ICEPwd: "newpwd", Media: []SDPFragMedia{
+				{Mid: "1", Candidates: []string{otherCandidate}, EndOfCandidates: true},
+				{Mid: "0", Candidates: []string{hostCandidate}},
+			}},
+			candidates: map[string][]string{"0": {hostCandidate}, "1": {otherCandidate}},
+			ended:      map[string]bool{"1": true},
+			ufrag:      "newufrag",
+			pwd:        "newpwd",
+		},
+		{
+			name: "session end of candidates",
+			frag: &SDPFrag{ICEUfrag: "newufrag", ICEPwd: "newpwd", EndOfCandidates: true, Media: []SDPFragMedia{
+				{Mid: "0", Candidates: []string{hostCandidate}},
+			}},
+			candidates: map[string][]string{"0": {hostCandidate}},
+			ended:      map[string]bool{"0": true},
+			ufrag:      "newufrag",
+			pwd:        "newpwd",
+		},
+		{
+			name: "unknown mid",
+			frag: &SDPFrag{ICEUfrag: "newufrag", ICEPwd: "newpwd", Media: []SDPFragMedia{
+				{Mid: "7", Candidates: []string{hostCandidate}},
+			}},
+			candidates: map[string][]string{},
+			ended:      map[string]bool{},
+			ufrag:      "newufrag",
+			pwd:        "newpwd",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desc := ApplySDPFrag(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: twoMediaSDP}, test.frag)
+			if desc.Type != webrtc.SDPTypeOffer {
+				t.Errorf("got type %v", desc.Type)
+			}
+
+			session := parseICESession(desc.SDP)
+			if session.ufrag != test.ufrag || session.pwd != test.pwd {
+				t.Errorf("got credentials %q %q, want %q %q", session.ufrag, session.pwd, test.ufrag, test.pwd)
+			}
+			if strings.Contains(desc.SDP, "oldufrag") || strings.Contains(desc.SDP, "oldpwd") {
+				t.Errorf("previous credentials left in\n%s", desc.SDP)
+			}
+			if session.mids["0"] != 0 || session.mids["1"] != 1 {
+				t.Errorf("media sections reordered: %v", session.mids)
+			}
+
+			candidates := map[string][]string{}
+			for _, candidate := range session.candidates {
+				candidates[*candidate.SDPMid] = append(candidates[*candidate.SDPMid], candidate.Candidate)
+			}
+			if !reflect.DeepEqual(candidates, test.candidates) {
+				t.Errorf("got candidates %v, want %v", candidates, test.candidates)
+			}
+			if ended := endedMids(desc.SDP); !reflect.DeepEqual(ended, test.ended) {
+				t.Errorf("got end of candidates %v, want %v", ended, test.ended)
+			}
+		})
+	}
+}
+
+// endedMids returns the media sections of sdp holding an end-of-candidates
+func endedMids(sdp string) map[string]bool {
+	ended := map[string]bool{}
+	mid := ""
+	for _, line := range strings.Split(sdp, "\r\n") {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case line == "a=end-of-candidates":
+			ended[mid] = true
+		}
+	}
+	return ended
+}
+
+func TestDescriptionSDPFrag(t *testing.T) {
+	frag := DescriptionSDPFrag(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: twoMediaSDP})
+	want := &SDPFrag{ICEUfrag: "oldufrag", ICEPwd: "oldpwdoldpwdoldpwdoldpwd", Media: []SDPFragMedia{
+		{Mid: "0", Candidates: []string{"candidate:9 1 udp 1 198.51.100.9 9 typ host"}, EndOfCandidates: true},
+	}}
+	if !reflect.DeepEqual(frag, want) {
+		t.Errorf("got %+v, want %+v", frag, want)
+	}
+}
+
+// answeredPeer returns a peer with twoMediaSDP as remote offer
+func answeredPeer(t *testing.T) *peer {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: twoMediaSDP + "a=fingerprint:sha-256 " + strings.Repeat("00:", 31) + "00\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	return &peer{pc: pc}
+}
+
+func TestIsICERestart(t *testing.T) {
+	tests := []struct {
+		name string
+		frag string
+		want bool
+	}{
+		{
+			name: "candidates only",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+		},
+		{
+			name: "current credentials",
+			frag: "a=ice-ufrag:oldufrag\r\na=ice-pwd:oldpwdoldpwdoldpwdoldpwd\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+		},
+		{
+			name: "current ufrag only",
+			frag: "a=ice-ufrag:oldufrag\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+		},
+		{
+			name: "new ufrag without pwd",
+			frag: "a=ice-ufrag:newufrag\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\n",
+		},
+		{
+			name: "new session credentials",
+			frag: "a=ice-ufrag:newufrag\r\na=ice-pwd:newpwdnewpwdnewpwdnewpwd\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+			want: true,
+		},
+		{
+			name: "new media credentials",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=ice-ufrag:newufrag\r\na=ice-pwd:newpwdnewpwdnewpwdnewpwd\r\n",
+			want: true,
+		},
+	}
+
+	p := answeredPeer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frag, err := ParseSDPFrag(test.frag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.IsICERestart(frag); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrickle(t *testing.T) {
+	tests := []struct {
+		name string
+		frag string
+		err  error
+	}{
+		{
+			name: "first media section",
+			frag: "a=ice-ufrag:oldufrag\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+		},
+		{
+			name: "multiple media sections",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n" +
+				"m=audio 9 RTP/AVP 0\r\na=mid:1\r\na=ice-ufrag:oldufrag\r\na=" + otherCandidate + "\r\n",
+		},
+		{
+			name: "end of candidates",
+			frag: "a=end-of-candidates\r\n",
+		},
+		{
+			name: "ufrag mismatch",
+			frag: "a=ice-ufrag:newufrag\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n",
+			err:  ErrICEUfragMismatch,
+		},
+		{
+			name: "media ufrag mismatch",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + hostCandidate + "\r\n" +
+				"m=audio 9 RTP/AVP 0\r\na=mid:1\r\na=ice-ufrag:newufrag\r\n",
+			err: ErrICEUfragMismatch,
+		},
+		{
+			name: "unknown mid",
+			frag: "m=audio 9 RTP/AVP 0\r\na=mid:7\r\na=" + hostCandidate + "\r\n",
+			err:  ErrUnknownMid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frag, err := ParseSDPFrag(test.frag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = answeredPeer(t).Trickle(frag)
+			if test.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned for a missing or unknown token
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned for a token that does not grant the request
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Authorizer decides whether the bearer token of a request, empty when none was
+// sent, allows mode on a stream. A returned ErrForbidden is answered with 403,
+// any other error with 401.
+type Authorizer interface {
+	Authorize(mode, room, stream, token string) error
+}
+
+// BitrateLimiter is implemented by Authorizers whose tokens limit the bitrate
+// of the session they create, in bits per second, 0 meaning no limit
+type BitrateLimiter interface {
+	MaxBitrate(token string) int
+}
+
+// PriorityAuthorizer is implemented by Authorizers whose tokens set the priority
+// of the publisher they create, PriorityPrimary or PriorityBackup. An empty
+// priority leaves it to the request.
+type PriorityAuthorizer interface {
+	Priority(token string) string
+}
+
+// TokenConfig grants a token to a mode on a stream. An empty Room, Stream or
+// Mode matches all rooms, streams or modes.
+type TokenConfig struct {
+	Room   string `mapstructure:"room"`
+	Stream string `mapstructure:"stream"`
+	Mode   string `mapstructure:"mode"`
+	Token  string `mapstructure:"token"`
+	// Priority, when set, is the priority of the publishers with the token
+	Priority string `mapstructure:"priority"`
+}
+
+func (c *TokenConfig) matches(mode, room, stream string) bool {
+	return (c.Room == "" || c.Room == room) &&
+		(c.Stream == "" || c.Stream == stream) &&
+		(c.Mode == "" || c.Mode == mode)
+}
+
+// StaticTokens authorizes requests with a fixed set of tokens. A stream
+// without any matching entry is open to everyone, the server events are
+// open only when no token is configured.
+type StaticTokens []TokenConfig
+
+// Authorize implements Authorizer
+func (t StaticTokens) Authorize(mode, room, stream, token string) error {
+	protected := mode == ModeEvents && len(t) > 0
+	for i := range t {
+		if !t[i].matches(mode, room, stream) {
+			continue
+		}
+		protected = true
+		if token != "" && subtle.ConstantTimeCompare([]byte(t[i].Token), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	if !protected {
+		return nil
+	}
+
+	// a token granted for other streams is known but not allowed here
+	for i := range t {
+		if token != "" && subtle.ConstantTimeCompare([]byte(t[i].Token), []byte(token)) == 1 {
+			return ErrForbidden
+		}
+	}
+	return ErrUnauthorized
+}
+
+// Priority implements PriorityAuthorizer
+func (t StaticTokens) Priority(token string) string {
+	for i := range t {
+		if token != "" && subtle.ConstantTimeCompare([]byte(t[i].Token), []byte(token)) == 1 && t[i].Priority != "" {
+			return t[i].Priority
+		}
+	}
+	return ""
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("bearer ") && strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(auth[len("bearer "):])
+	}
+	return ""
+}
+
+// authorize checks the request against the Authorizer of the server, writing
+// the error response when it is denied
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, mode, room, stream string) bool {
+	if s.Authorizer == nil {
+		return true
+	}
+
+	err := s.Authorizer.Authorize(mode, room, stream, bearerToken(r))
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, ErrForbidden) {
+		writeError(w, http.StatusForbidden, "403 - "+mode+" "+room+"/"+stream+" not allowed")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="whip"`)
+	writeError(w, http.StatusUnauthorized, "401 - "+err.Error())
+	return false
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Event is one of SessionCreated, TrackStarted, TrackEnded, SubscriberJoined,
+// SubscriberLeft, PublisherGone, PublisherActivated and ICESelectedPair
+type Event interface {
+	session() *Session
+}
+
+// SessionCreated is emitted once a session has been accepted
+type SessionCreated struct {
+	Session *Session
+}
+
+// TrackStarted is emitted when a publisher starts sending a track
+type TrackStarted struct {
+	Session *Session
+	Track   *webrtc.TrackRemote
+}
+
+// TrackEnded is emitted when the OnTrack callback of a track returns, or at
+// the latest when its publisher is gone
+type TrackEnded struct {
+	Session *Session
+	Track   *webrtc.TrackRemote
+}
+
+// SubscriberJoined is emitted once a subscribe session has been accepted,
+// Viewers counts the subscribers of the stream
+type SubscriberJoined struct {
+	Session *Session
+	Viewers int
+}
+
+// SubscriberLeft is emitted once a subscribe session has been removed
+type SubscriberLeft struct {
+	Session *Session
+	Viewers int
+	// Reason is deleted, closed or failed
+	Reason string
+}
+
+// PublisherGone is emitted once a publish session has been removed
+type PublisherGone struct {
+	Session *Session
+	// Reason is deleted, closed, failed or replaced
+	Reason string
+}
+
+// PublisherActivated is emitted when a publish session becomes the active publisher
+// of its stream, see Server.Publisher. Previous is the publisher it replaces, if any.
+type PublisherActivated struct {
+	Session  *Session
+	Previous *Session
+}
+
+// ICESelectedPair is emitted when ICE selects the candidate pair of a session
+type ICESelectedPair struct {
+	Session *Session
+	Pair    *webrtc.ICECandidatePair
+}
+
+func (e *SessionCreated) session() *Session     { return e.Session }
+func (e *TrackStarted) session() *Session       { return e.Session }
+func (e *TrackEnded) session() *Session         { return e.Session }
+func (e *SubscriberJoined) session() *Session   { return e.Session }
+func (e *SubscriberLeft) session() *Session     { return e.Session }
+func (e *PublisherGone) session() *Session      { return e.Session }
+func (e *PublisherActivated) session() *Session { return e.Session }
+func (e *ICESelectedPair) session() *Session    { return e.Session }
+
+// EventBus delivers the events of a server to its subscribers. Every subscriber
+// gets the events of a session in the order they happened, a session has no
+// events after its PublisherGone or SubscriberLeft.
+type EventBus struct {
+	lock        sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Subscribe returns a channel receiving all events until cancel is called.
+// Events are queued while the channel is not read.
+func (b *EventBus) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event)
+	sub := newSubscriber(func(e Event, done <-chan struct{}) {
+		select {
+		case ch <- e:
+		case <-done:
+		}
+	})
+	go func() {
+		sub.run()
+		close(ch)
+	}()
+	return ch, b.add(sub)
+}
+
+// OnEvent calls f with every event until cancel is called, one event at a time
+func (b *EventBus) OnEvent(f func(e Event)) (cancel func()) {
+	sub := newSubscriber(func(e Event, done <-chan struct{}) {
+		f(e)
+	})
+	go sub.run()
+	return b.add(sub)
+}
+
+func (b *EventBus) add(sub *subscriber) func() {
+	b.lock.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, sub)
+			b.lock.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+func (b *EventBus) publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sub := range b.subscribers {
+		sub.push(e)
+	}
+}
+
+// subscriber queues the events so that publishing never waits for delivery
+type subscriber struct {
+	deliver func(e Event, done <-chan struct{})
+	lock    sync.Mutex
+	queue   []Event
+	notify  chan struct{}
+	done    chan struct{}
+}
+
+func newSubscriber(deliver func(e Event, done <-chan struct{})) *subscriber {
+	return &subscriber{
+		deliver: deliver,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *subscriber) push(e Event) {
+	s.lock.Lock()
+	s.queue = append(s.queue, e)
+	s.lock.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+
+		s.lock.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.lock.Unlock()
+
+		for _, e := range queue {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.deliver(e, s.done)
+		}
+	}
+}
+
+// emit publishes an event of session, the final event of a session is its last one
+func (s *Server) emit(e Event, final bool) {
+	session := e.session()
+	session.eventLock.Lock()
+	defer session.eventLock.Unlock()
+
+	if session.gone {
+		return
+	}
+	switch e := e.(type) {
+	case *TrackStarted:
+		session.liveTracks[e.Track] = true
+	case *TrackEnded:
+		if !session.liveTracks[e.Track] {
+			return
+		}
+		delete(session.liveTracks, e.Track)
+	}
+	if final {
+		// the tracks still running end before their publisher is gone
+		for track := range session.liveTracks {
+			s.events.publish(&TrackEnded{Session: session, Track: track})
+		}
+		session.liveTracks = nil
+		session.gone = true
+	}
+	s.events.publish(e)
+}
+
+// watchSession emits the track events of a publish session around its OnTrack
+// callback, and the selected candidate pairs of a session
+func (s *Server) watchSession(session *Session) {
+	if session.Conn != nil {
+		onTrack := session.Conn.OnTrack
+		session.Conn.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			s.emit(&TrackStarted{Session: session, Track: track}, false)
+			if onTrack != nil {
+				onTrack(pc, track, receiver)
+				s.emit(&TrackEnded{Session: session, Track: track}, false)
+			}
+		}
+	}
+	session.onSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		s.emit(&ICESelectedPair{Session: session, Pair: pair}, false)
+	})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// defaultIngestTimeout is the failover timeout when IngestTimeout is zero
+	defaultIngestTimeout = 2 * time.Second
+	// defaultFailbackDelay is the switch back delay when FailbackDelay is zero
+	defaultFailbackDelay = 5 * time.Second
+)
+
+func (s *Server) ingestTimeout() time.Duration {
+	if s.IngestTimeout > 0 {
+		return s.IngestTimeout
+	}
+	return defaultIngestTimeout
+}
+
+func (s *Server) failbackDelay() time.Duration {
+	if s.FailbackDelay > 0 {
+		return s.FailbackDelay
+	}
+	return defaultFailbackDelay
+}
+
+// monitor elects the active publishers of the streams as their packets stop and
+// resume, until the server is closed
+func (s *Server) monitor() {
+	ticker := time.NewTicker(s.ingestTimeout() / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		streams := make(map[[2]string]bool)
+		for _, session := range s.Sessions() {
+			if session.Mode == ModePublish {
+				streams[[2]string{session.Room, session.Stream}] = true
+			}
+		}
+		for stream := range streams {
+			s.failover(stream[0], stream[1])
+		}
+	}
+}
+
+// failover elects the active publisher of a stream: the primary while it receives
+// packets, else the backup while it does. A recovered primary takes over from a
+// receiving backup once it received packets for FailbackDelay. When neither
+// receives, the active publisher is kept, a new one is the primary if any.
+func (s *Server) failover(room, stream string) {
+	s.failoverLock.Lock()
+	defer s.failoverLock.Unlock()
+
+	key := room + "/" + stream
+	timeout := s.ingestTimeout()
+	now := time.Now()
+
+	s.lock.Lock()
+	primary := s.publisher(room, stream, PriorityPrimary)
+	backup := s.publisher(room, stream, PriorityBackup)
+	previous := s.active[key]
+	receiving := func(session *Session) bool {
+		if session == nil {
+			return false
+		}
+		if now.Sub(session.Conn.LastPacket()) >= timeout {
+			session.receivingSince = time.Time{}
+			return false
+		}
+		if session.receivingSince.IsZero() {
+			session.receivingSince = now
+		}
+		return true
+	}
+	primaryUp, backupUp := receiving(primary), receiving(backup)
+
+	var active *Session
+	switch {
+	case primaryUp && (previous == primary || !backupUp || now.Sub(primary.receivingSince) >= s.failbackDelay()):
+		active = primary
+	case backupUp:
+		active = backup
+	case primaryUp:
+		active = primary
+	case previous != nil && s.sessions[previous.ID] == previous:
+		active = previous
+	case primary != nil:
+		active = primary
+	default:
+		active = backup
+	}
+	if active == nil {
+		delete(s.active, key)
+	} else {
+		s.active[key] = active
+	}
+	s.lock.Unlock()
+
+	if active != nil && active != previous {
+		log.Printf("active publisher of %v: %v (%v)", key, active.ID, active.Priority)
+		s.emit(&PublisherActivated{Session: active, Previous: previous}, false)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 5 * time.Second
+
+// HooksConfig holds the urls notified SRS-style of the sessions. A session is
+// only accepted when all of its on_publish or on_play urls answer with 2xx.
+type HooksConfig struct {
+	OnPublish   []string `mapstructure:"on_publish"`
+	OnUnpublish []string `mapstructure:"on_unpublish"`
+	OnPlay      []string `mapstructure:"on_play"`
+	OnStop      []string `mapstructure:"on_stop"`
+	// Timeout of a callback in seconds
+	Timeout int `mapstructure:"timeout"`
+}
+
+// HookEvent is the JSON body POSTed to the hooks
+type HookEvent struct {
+	Action   string         `json:"action"`
+	Mode     string         `json:"mode"`
+	Room     string         `json:"room"`
+	Stream   string         `json:"stream"`
+	ID       string         `json:"id"`
+	ClientIP string         `json:"client_ip"`
+	Token    string         `json:"token,omitempty"`
+	Media    []MediaSummary `json:"media,omitempty"`
+	// Reason tells why an ended session was removed: deleted, closed, failed or replaced
+	Reason string `json:"reason,omitempty"`
+}
+
+// MediaSummary describes a media section of the offer of a session
+type MediaSummary struct {
+	Kind      string   `json:"kind"`
+	Mid       string   `json:"mid,omitempty"`
+	Direction string   `json:"direction,omitempty"`
+	Codecs    []string `json:"codecs,omitempty"`
+	RIDs      []string `json:"rids,omitempty"`
+}
+
+// Hooks calls the configured urls on session events
+type Hooks struct {
+	HooksConfig
+	HTTPClient *http.Client
+}
+
+// NewHooks creates Hooks with an http client bounded by the configured timeout
+func NewHooks(c HooksConfig) *Hooks {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return &Hooks{
+		HooksConfig: c,
+		HTTPClient:  &http.Client{Timeout: timeout},
+	}
+}
+
+// accept calls on_publish or on_play, a failed call rejects the session
+func (h *Hooks) accept(session *Session, offer []byte) error {
+	action, urls := "on_publish", h.OnPublish
+	if session.Mode == ModeSubscribe {
+		action, urls = "on_play", h.OnPlay
+	}
+
+	event := newHookEvent(action, session)
+	event.Media = summarizeSDP(string(offer))
+	for _, url := range urls {
+		if err := h.post(url, event); err != nil {
+			return fmt.Errorf("%w: %s %v", ErrForbidden, action, err)
+		}
+	}
+	return nil
+}
+
+// notify calls on_unpublish or on_stop in the background
+func (h *Hooks) notify(session *Session, reason string) {
+	action, urls := "on_unpublish", h.OnUnpublish
+	if session.Mode == ModeSubscribe {
+		action, urls = "on_stop", h.OnStop
+	}
+
+	event := newHookEvent(action, session)
+	event.Reason = reason
+	for _, url := range urls {
+		go func(url string) {
+			if err := h.post(url, event); err != nil {
+				log.Printf("%v hook: %v", action, err)
+			}
+		}(url)
+	}
+}
+
+func newHookEvent(action string, session *Session) *HookEvent {
+	return &HookEvent{
+		Action:   action,
+		Mode:     session.Mode,
+		Room:     session.Room,
+		Stream:   session.Stream,
+		ID:       session.ID,
+		ClientIP: session.ClientIP,
+		Token:    session.token,
+	}
+}
+
+func (h *Hooks) post(url string, event *HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	res, err := h.HTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%v answered %d: %s", url, res.StatusCode, resBody)
+	}
+	return nil
+}
+
+// summarizeSDP lists the media sections of an sdp with their codecs and simulcast rids
+func summarizeSDP(sdp string) []MediaSummary {
+	var media []MediaSummary
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "m=") {
+			kind := strings.SplitN(line[2:], " ", 2)[0]
+			media = append(media, MediaSummary{Kind: kind})
+			continue
+		}
+		if len(media) == 0 || !strings.HasPrefix(line, "a=") {
+			continue
+		}
+
+		m := &media[len(media)-1]
+		attr := line[2:]
+		switch {
+		case attr == "sendonly" || attr == "recvonly" || attr == "sendrecv" || attr == "inactive":
+			m.Direction = attr
+		case strings.HasPrefix(attr, "mid:"):
+			m.Mid = strings.TrimPrefix(attr, "mid:")
+		case strings.HasPrefix(attr, "rtpmap:"):
+			// rtpmap:<payload type> <encoding name>/<clock rate>
+			if fields := strings.Fields(attr); len(fields) == 2 {
+				codec := strings.SplitN(fields[1], "/", 2)[0]
+				if !contains(m.Codecs, codec) {
+					m.Codecs = append(m.Codecs, codec)
+				}
+			}
+		case strings.HasPrefix(attr, "rid:"):
+			if fields := strings.Fields(strings.TrimPrefix(attr, "rid:")); len(fields) > 0 {
+				m.RIDs = append(m.RIDs, fields[0])
+			}
+		}
+	}
+	return media
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures the verification of JWT stream tokens, signed with
+// HS256 using Secret or with ES256 using the key of the PublicKey file.
+type JWTConfig struct {
+	Secret string `mapstructure:"secret"`
+	// PublicKey is the path of a PEM encoded P-256 public key
+	PublicKey string `mapstructure:"publickey"`
+}
+
+// StreamClaims are the claims of a stream token. An empty Room, Stream or
+// Mode allows all rooms, streams or modes. Exp is required, Nbf optional.
+type StreamClaims struct {
+	Room   string `json:"room"`
+	Stream string `json:"stream"`
+	Mode   string `json:"mode"`
+	Exp    int64  `json:"exp"`
+	Nbf    int64  `json:"nbf,omitempty"`
+	// MaxBitrate limits the bitrate of a publisher, in bits per second
+	MaxBitrate int `json:"max_bitrate"`
+	// Priority is the priority of a publisher, primary or backup
+	Priority string `json:"priority,omitempty"`
+}
+
+// JWTAuthorizer authorizes requests with JWT stream tokens minted by a backend
+type JWTAuthorizer struct {
+	secret []byte
+	key    *ecdsa.PublicKey
+}
+
+// NewJWTAuthorizer creates a JWTAuthorizer, at least one of the secret and
+// the public key has to be configured
+func NewJWTAuthorizer(c JWTConfig) (*JWTAuthorizer, error) {
+	a := &JWTAuthorizer{secret: []byte(c.Secret)}
+
+	if c.PublicKey != "" {
+		data, err := ioutil.ReadFile(c.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %v", c.PublicKey)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%v is not a P-256 public key", c.PublicKey)
+		}
+		a.key = ecKey
+	}
+
+	if len(a.secret) == 0 && a.key == nil {
+		return nil, errors.New("jwt needs a secret or a public key")
+	}
+	return a, nil
+}
+
+// Verify checks the signature and validity period of a token and returns its claims
+func (a *JWTAuthorizer) Verify(token string) (*StreamClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthorized)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthorized)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && len(a.secret) > 0:
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+		}
+	case header.Alg == "ES256" && a.key != nil:
+		// the signature is the concatenation of r and s, 32 bytes each
+		if len(signature) != 64 {
+			return nil, fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(a.key, digest[:], r, s) {
+			return nil, fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrUnauthorized, header.Alg)
+	}
+
+	claims := &StreamClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.Exp == 0 || time.Now().Unix() >= claims.Exp {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthorized)
+	}
+	if claims.Nbf != 0 && time.Now().Unix() < claims.Nbf {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrUnauthorized)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrUnauthorized)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed token", ErrUnauthorized)
+	}
+	return nil
+}
+
+// Authorize implements Authorizer
+func (a *JWTAuthorizer) Authorize(mode, room, stream, token string) error {
+	if token == "" {
+		return ErrUnauthorized
+	}
+	claims, err := a.Verify(token)
+	if err != nil {
+		return err
+	}
+	if (claims.Room != "" && claims.Room != room) ||
+		(claims.Stream != "" && claims.Stream != stream) ||
+		(claims.Mode != "" && claims.Mode != mode) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// MaxBitrate implements BitrateLimiter
+func (a *JWTAuthorizer) MaxBitrate(token string) int {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return 0
+	}
+	return claims.MaxBitrate
+}
+
+// Priority implements PriorityAuthorizer
+func (a *JWTAuthorizer) Priority(token string) string {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return ""
+	}
+	return claims.Priority
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "jwt-test-secret"
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 mints a token with an HS256 signature by secret
+func signHS256(t *testing.T, secret []byte, claims interface{}) string {
+	return signWithAlg(t, "HS256", secret, claims)
+}
+
+// signES256 mints a token with an ES256 signature by key
+func signES256(t *testing.T, key *ecdsa.PrivateKey, claims interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "ES256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// unsigned mints a token with alg none and an empty signature
+func unsigned(t *testing.T, claims interface{}) string {
+	return encodeSegment(t, map[string]string{"alg": "none", "typ": "JWT"}) + "." + encodeSegment(t, claims) + "."
+}
+
+// writePublicKey writes the PEM public key of key to a temporary file and
+// returns its path and content
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) (string, []byte) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "public.pem")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestJWTVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, keyPEM := writePublicKey(t, key)
+
+	hs, err := NewJWTAuthorizer(JWTConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewJWTAuthorizer(JWTConfig{PublicKey: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	both, err := NewJWTAuthorizer(JWTConfig{Secret: testSecret, PublicKey: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := StreamClaims{Room: "live", Stream: "s", Exp: now + 60}
+
+	tests := []struct {
+		name       string
+		authorizer *JWTAuthorizer
+		token      string
+		valid      bool
+	}{
+		{"hs256", hs, signHS256(t, []byte(testSecret), valid), true},
+		{"es256", es, signES256(t, key, valid), true},
+		{"hs256 with both", both, signHS256(t, []byte(testSecret), valid), true},
+		{"es256 with both", both, signES256(t, key, valid), true},
+
+		{"alg none", hs, unsigned(t, valid), false},
+		{"alg none with key", es, unsigned(t, valid), false},
+		{"alg none with hs256 signature", hs, signWithAlg(t, "none", []byte(testSecret), valid), false},
+		{"unknown alg", hs, signWithAlg(t, "HS512", []byte(testSecret), valid), false},
+
+		// the public key used as an HMAC secret must not verify
+		{"hs256 signed by the public key", es, signHS256(t, keyPEM, valid), false},
+		{"hs256 signed by the public key with both", both, signHS256(t, keyPEM, valid), false},
+		{"es256 without key", hs, signES256(t, key, valid), false},
+
+		{"wrong secret", hs, signHS256(t, []byte("other-secret"), valid), false},
+		{"wrong key", es, signES256(t, otherKey, valid), false},
+		{"tampered claims", hs, tamper(t, signHS256(t, []byte(testSecret), valid), StreamClaims{Exp: now + 60}), false},
+		{"truncated es256 signature", es, signES256(t, key, valid)[:60], false},
+
+		{"expired", hs, signHS256(t, []byte(testSecret), StreamClaims{Exp: now - 1}), false},
+		{"expiring now", hs, signHS256(t, []byte(testSecret), StreamClaims{Exp: now}), false},
+		{"expired es256", es, signES256(t, key, StreamClaims{Exp: now - 60}), false},
+		{"without exp", hs, signHS256(t, []byte(testSecret), StreamClaims{}), false},
+		{"not valid yet", hs, signHS256(t, []byte(testSecret), StreamClaims{Exp: now + 120, Nbf: now + 60}), false},
+		{"valid since nbf", hs, signHS256(t, []byte(testSecret), StreamClaims{Exp: now + 120, Nbf: now - 1}), true},
+
+		{"two segments", hs, "e30.e30", false},
+		{"malformed header", hs, "!!!.e30.", false},
+		{"malformed claims", hs, encodeSegment(t, map[string]string{"alg": "HS256"}) + ".bm90IGpzb24." + "AAAA", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.authorizer.Verify(test.token)
+			if !test.valid {
+				if !errors.Is(err, ErrUnauthorized) {
+					t.Fatalf("got claims %+v and error %v, want ErrUnauthorized", claims, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Exp == 0 {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+// signWithAlg mints a token with alg in its header and an HS256 signature
+func signWithAlg(t *testing.T, alg string, secret []byte, claims interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tamper returns token with its claims replaced, keeping its signature
+func tamper(t *testing.T, token string, claims interface{}) string {
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + encodeSegment(t, claims) + "." + parts[2]
+}
+
+func TestJWTAuthorize(t *testing.T) {
+	a, err := NewJWTAuthorizer(JWTConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Unix() + 60
+	token := func(claims StreamClaims) string {
+		claims.Exp = exp
+		return signHS256(t, []byte(testSecret), claims)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		mode   string
+		room   string
+		stream string
+		err    error
+	}{
+		{"scoped", token(StreamClaims{Room: "live", Stream: "s", Mode: ModePublish}), ModePublish, "live", "s", nil},
+		{"any stream of the room", token(StreamClaims{Room: "live"}), ModeSubscribe, "live", "other", nil},
+		{"any room", token(StreamClaims{}), ModePublish, "other", "s", nil},
+
+		{"wrong room", token(StreamClaims{Room: "live", Stream: "s"}), ModePublish, "other", "s", ErrForbidden},
+		{"wrong stream", token(StreamClaims{Room: "live", Stream: "s"}), ModePublish, "live", "other", ErrForbidden},
+		{"wrong mode", token(StreamClaims{Room: "live", Mode: ModeSubscribe}), ModePublish, "live", "s", ErrForbidden},
+		{"wrong stream of any room", token(StreamClaims{Stream: "s"}), ModePublish, "live", "other", ErrForbidden},
+		{"room scoped token for the events", token(StreamClaims{Room: "live"}), ModeEvents, "", "", ErrForbidden},
+
+		{"without token", "", ModePublish, "live", "s", ErrUnauthorized},
+		{"expired", signHS256(t, []byte(testSecret), StreamClaims{Room: "live", Exp: exp - 120}), ModePublish, "live", "s", ErrUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := a.Authorize(test.mode, test.room, test.stream, test.token)
+			if test.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	a, err := NewJWTAuthorizer(JWTConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Unix() + 60
+	token := signHS256(t, []byte(testSecret), StreamClaims{Exp: exp, MaxBitrate: 2500000, Priority: PriorityBackup})
+	if bitrate := a.MaxBitrate(token); bitrate != 2500000 {
+		t.Errorf("got max bitrate %v", bitrate)
+	}
+	if priority := a.Priority(token); priority != PriorityBackup {
+		t.Errorf("got priority %q", priority)
+	}
+
+	// the claims of a token failing verification are ignored
+	forged := signHS256(t, []byte("other-secret"), StreamClaims{Exp: exp, MaxBitrate: 2500000, Priority: PriorityBackup})
+	if bitrate := a.MaxBitrate(forged); bitrate != 0 {
+		t.Errorf("got max bitrate %v of a forged token", bitrate)
+	}
+	if priority := a.Priority(forged); priority != "" {
+		t.Errorf("got priority %q of a forged token", priority)
+	}
+}
+
+func TestNewJWTAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Path, _ := writePublicKey(t, p384)
+
+	for name, c := range map[string]JWTConfig{
+		"empty":       {},
+		"missing key": {PublicKey: filepath.Join(dir, "missing.pem")},
+		"not PEM":     {PublicKey: notPEM},
+		"P-384 key":   {PublicKey: p384Path},
+	} {
+		if _, err := NewJWTAuthorizer(c); err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+}
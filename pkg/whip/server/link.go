@@ -0,0 +1,32 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// iceServerLinks formats ice servers as WHIP Link header values, one per url:
+//
+//	<turn:turn.example.net?transport=udp>; rel="ice-server"; username="user"; credential="pass"; credential-type="password"
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := "<" + url + ">; rel=\"ice-server\""
+			if server.Username != "" {
+				link += "; username=" + quote(server.Username)
+			}
+			if credential, ok := server.Credential.(string); ok && credential != "" {
+				link += "; credential=" + quote(credential) + "; credential-type=\"password\""
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// quote returns s as an http quoted-string
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics collects the counters of a server, its gauges are computed from the
+// sessions when scraped
+type metrics struct {
+	lock        sync.Mutex
+	requests    map[[2]string]int
+	offerAnswer map[string]*histogram
+	iceConnect  map[string]*histogram
+	// traffic of the removed sessions
+	removed  traffic
+	counters []counter
+}
+
+// traffic sums the RTP packets and feedback of connections
+type traffic struct {
+	bytesReceived, bytesSent     uint64
+	packetsReceived, packetsSent uint64
+	plisSent, plisReceived       uint64
+}
+
+// add adds the totals of a connection, which count the tracks removed from it
+// too: the counters never go down as subscribers drop tracks
+func (t *traffic) add(stats *whip.Stats) {
+	t.bytesReceived += stats.Totals.BytesReceived
+	t.bytesSent += stats.Totals.BytesSent
+	t.packetsReceived += stats.Totals.PacketsReceived
+	t.packetsSent += stats.Totals.PacketsSent
+	t.plisSent += stats.Totals.PLIsSent
+	t.plisReceived += stats.Totals.PLIsReceived
+}
+
+// counter is a counter of the application exported with the server metrics
+type counter struct {
+	name, help string
+	value      func() float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:    make(map[[2]string]int),
+		offerAnswer: make(map[string]*histogram),
+		iceConnect:  make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) countRequest(method string, code int) {
+	m.lock.Lock()
+	m.requests[[2]string{method, strconv.Itoa(code)}]++
+	m.lock.Unlock()
+}
+
+func (m *metrics) observe(histograms map[string]*histogram, mode string, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h := histograms[mode]
+	if h == nil {
+		h = newHistogram(latencyBuckets)
+		histograms[mode] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// histogram is a Prometheus histogram
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// label formats a label pair, escaping its value
+func label(name, value string) string {
+	return name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// statusRecorder keeps the status code of a response, 200 unless another one is written
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// AddCounter exports a counter of the application with the server metrics,
+// value is read on every scrape
+func (s *Server) AddCounter(name, help string, value func() float64) {
+	s.metrics.lock.Lock()
+	s.metrics.counters = append(s.metrics.counters, counter{name: name, help: help, value: value})
+	s.metrics.lock.Unlock()
+}
+
+// MetricsHandler returns the handler of /metrics, serving the metrics in the
+// Prometheus text exposition format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(s.serveMetrics)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+
+	// the sessions are listed under the metrics lock, a session is either live
+	// or its traffic is in the removed totals. Their stats are collected after
+	// releasing it, the sessions being added and removed meanwhile.
+	m.lock.Lock()
+	live := s.Sessions()
+	total := m.removed
+	m.lock.Unlock()
+
+	sessions := make(map[[2]string]int)
+	for _, session := range live {
+		sessions[[2]string{session.Room, session.Mode}]++
+		total.add(session.conn().Stats())
+	}
+
+	// the response is rendered first, a slow scrape does not hold the lock
+	var b bytes.Buffer
+	m.lock.Lock()
+	writeHeader(&b, "whip_sessions", "gauge", "Active sessions per room and mode.")
+	for _, key := range sortedKeys(sessions) {
+		fmt.Fprintf(&b, "whip_sessions{%s,%s} %d\n", label("room", key[0]), label("mode", key[1]), sessions[key])
+	}
+
+	writeHeader(&b, "whip_http_requests_total", "counter", "POST, PATCH and DELETE requests by method and status code.")
+	for _, key := range sortedKeys(m.requests) {
+		fmt.Fprintf(&b, "whip_http_requests_total{%s,%s} %d\n", label("method", key[0]), label("code", key[1]), m.requests[key])
+	}
+
+	writeHeader(&b, "whip_offer_answer_seconds", "histogram", "Time from receiving an offer to sending the answer, or making the offer of a server offer.")
+	writeHistograms(&b, "whip_offer_answer_seconds", m.offerAnswer)
+	writeHeader(&b, "whip_ice_connect_seconds", "histogram", "Time from creating a session to its peer connection being connected.")
+	writeHistograms(&b, "whip_ice_connect_seconds", m.iceConnect)
+
+	writeHeader(&b, "whip_rtp_bytes_total", "counter", "RTP bytes received from publishers and sent to subscribers.")
+	fmt.Fprintf(&b, "whip_rtp_bytes_total{direction=\"received\"} %d\n", total.bytesReceived)
+	fmt.Fprintf(&b, "whip_rtp_bytes_total{direction=\"sent\"} %d\n", total.bytesSent)
+	writeHeader(&b, "whip_rtp_packets_total", "counter", "RTP packets received from publishers and sent to subscribers.")
+	fmt.Fprintf(&b, "whip_rtp_packets_total{direction=\"received\"} %d\n", total.packetsReceived)
+	fmt.Fprintf(&b, "whip_rtp_packets_total{direction=\"sent\"} %d\n", total.packetsSent)
+	writeHeader(&b, "whip_pli_total", "counter", "Picture loss indications sent to publishers and received from subscribers.")
+	fmt.Fprintf(&b, "whip_pli_total{direction=\"sent\"} %d\n", total.plisSent)
+	fmt.Fprintf(&b, "whip_pli_total{direction=\"received\"} %d\n", total.plisReceived)
+
+	counters := append([]counter(nil), m.counters...)
+	m.lock.Unlock()
+
+	for _, c := range counters {
+		writeHeader(&b, c.name, "counter", c.help)
+		fmt.Fprintf(&b, "%s %s\n", c.name, formatFloat(c.value()))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func writeHistograms(w io.Writer, name string, histograms map[string]*histogram) {
+	modes := make([]string, 0, len(histograms))
+	for mode := range histograms {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		histograms[mode].write(w, name, label("mode", mode)+",")
+	}
+}
+
+func sortedKeys(m map[[2]string]int) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,804 @@
+// Package server provides an http.Handler implementing the WHIP and WHEP resource
+// lifecycle (create, trickle, delete) on top of whip.WHIPConn and whip.WHEPConn.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+	"github.com/rtcd/whip/pkg/util"
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+const (
+	ModePublish   = "publish"
+	ModeSubscribe = "subscribe"
+	// ModeEvents is authorized, with an empty room and stream, to read /whip/events
+	ModeEvents = "events"
+)
+
+// The priorities of the publishers of a stream, see Server.Publisher
+const (
+	PriorityPrimary = "primary"
+	PriorityBackup  = "backup"
+)
+
+// Session is a WHIP or WHEP resource created by a POST request
+type Session struct {
+	ID     string
+	Room   string
+	Stream string
+	Mode   string
+	// Conn is the ingest connection of a publish session
+	Conn *whip.WHIPConn
+	// WHEP is the egress connection of a subscribe session
+	WHEP *whip.WHEPConn
+	// Query holds the query parameters of the POST request
+	Query url.Values
+	// ClientIP is the address of the client that created the session
+	ClientIP string
+	// MaxBitrate, in bits per second, is set from the token by a BitrateLimiter.
+	// The bitrate of a publisher is limited to it, 0 meaning no limit.
+	MaxBitrate int
+	// Priority of a publisher is set by a PriorityAuthorizer or else by ?priority=
+	// of the POST request, PriorityPrimary by default
+	Priority string
+
+	prefix string
+	token  string
+	// etag identifies the ICE session, it changes on every ICE restart
+	etag      string
+	patchLock sync.Mutex
+
+	eventLock  sync.Mutex
+	gone       bool
+	liveTracks map[*webrtc.TrackRemote]bool
+	// sseEvents are the events selected for the event stream of a subscribe session
+	sseEvents map[string]bool
+
+	created     time.Time
+	connectOnce sync.Once
+	// receivingSince is when a publisher started receiving packets, see Server.failover
+	receivingSince time.Time
+}
+
+// Location returns the resource URL of the session
+func (s *Session) Location() string {
+	return s.prefix + "/" + s.Room + "/" + s.ID
+}
+
+// peerConn is implemented by both whip.WHIPConn and whip.WHEPConn
+type peerConn interface {
+	Trickle(frag *whip.SDPFrag) error
+	IsICERestart(frag *whip.SDPFrag) bool
+	RestartICE(frag *whip.SDPFrag) (*whip.SDPFrag, error)
+	PendingCandidates() *whip.SDPFrag
+	ICEServers() []webrtc.ICEServer
+	GetStats() webrtc.StatsReport
+	Stats() *whip.Stats
+	Close()
+}
+
+func (s *Session) conn() peerConn {
+	if s.Conn != nil {
+		return s.Conn
+	}
+	return s.WHEP
+}
+
+func (s *Session) onConnectionStateChange(f func(webrtc.PeerConnectionState)) {
+	if s.Conn != nil {
+		s.Conn.OnConnectionStateChange = f
+	} else {
+		s.WHEP.OnConnectionStateChange = f
+	}
+}
+
+func (s *Session) onSelectedCandidatePairChange(f func(*webrtc.ICECandidatePair)) {
+	if s.Conn != nil {
+		s.Conn.OnSelectedCandidatePairChange = f
+	} else {
+		s.WHEP.OnSelectedCandidatePairChange = f
+	}
+}
+
+// Server serves the WHIP and WHEP endpoints:
+//
+//	POST    /whip/publish/{room}/{stream}  create a publish session
+//	POST    /whep/{room}/{stream}          create a subscribe session, an empty body asks for a server offer
+//	POST    /whip/subscribe/{room}/{stream} create a subscribe session from a client offer
+//	PATCH   /whip/{room}/{id}              trickle ice candidates as an sdpfrag, the response trickles the server
+//	                                       candidates gathered since, or restart ice with new credentials
+//	PATCH   /whep/{room}/{id}              trickle ice candidates, or send the answer to a server offer
+//	DELETE  /whip/{room}/{id}              delete the session
+//	DELETE  /whep/{room}/{id}              delete the session
+//	GET     /whip/events                   server-sent events of the publishers, viewers, layers and stats
+//	POST    /whep/{room}/{id}/sse          select the server-sent events of a subscribe session
+//	GET     /whep/{room}/{id}/sse          server-sent events of the stream played by a subscribe session
+//	OPTIONS on all of the above, with the ice servers when the token is authorized
+type Server struct {
+	// OnPublish is called for a new publish session before its offer is answered.
+	// Set session.Conn callbacks here, returning an error rejects the session.
+	OnPublish func(s *Session) error
+	// OnSubscribe is called for a new subscribe session before it is negotiated,
+	// add the tracks to session.WHEP here. Subscribing is only served when it is set.
+	OnSubscribe func(s *Session) error
+	// OnDelete is called once a session has been removed, either by a DELETE request
+	// or because its peer connection was closed. It is not called for sessions
+	// rejected by OnPublish or OnSubscribe.
+	OnDelete func(s *Session)
+	// Codecs, if set, returns the codecs of a new session overriding those of the engine,
+	// an empty result keeps the engine codecs.
+	Codecs func(mode, room, stream string) []whip.CodecConfig
+	// Authorizer, if set, authorizes the bearer token of POST, PATCH and DELETE requests
+	Authorizer Authorizer
+	// Hooks, if set, are called before a session is accepted and once it is removed
+	Hooks *Hooks
+	// StatsInterval is the interval of the stats events of /whip/events, 5s when zero
+	StatsInterval time.Duration
+	// MaxSDPSize limits the size of the offer, answer and sdpfrag bodies, 64 KiB when zero
+	MaxSDPSize int64
+	// ReplacePublisher lets a new publisher of a stream replace the current one of its
+	// priority, which is removed once the new offer is answered, instead of being
+	// rejected with 409
+	ReplacePublisher bool
+	// IngestTimeout is the time without packets after which a publisher fails over
+	// to the other publisher of its stream, 2s when zero
+	IngestTimeout time.Duration
+	// FailbackDelay is how long a recovered primary publisher has to keep sending
+	// before it takes over from the backup again, 5s when zero
+	FailbackDelay time.Duration
+
+	engine   *whip.Engine
+	router   *mux.Router
+	events   *EventBus
+	metrics  *metrics
+	lock     sync.RWMutex
+	sessions map[string]*Session
+	// active holds the active publisher of the streams by room and stream
+	active       map[string]*Session
+	failoverLock sync.Mutex
+	monitorOnce  sync.Once
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// defaultMaxSDPSize is the body size limit when MaxSDPSize is zero
+const defaultMaxSDPSize = 64 << 10
+
+// New creates a WHIP server creating its connections with engine
+func New(engine *whip.Engine) *Server {
+	s := &Server{
+		engine:   engine,
+		events:   newEventBus(),
+		metrics:  newMetrics(),
+		sessions: make(map[string]*Session),
+		active:   make(map[string]*Session),
+		done:     make(chan struct{}),
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/whip/events", s.handleEvents).Methods("GET")
+	// only under /whep, /whip/{mode}/{room}/sse is a stream named sse
+	r.HandleFunc("/whep/{room}/{id}/sse", s.handleSSEPost).Methods("POST")
+	r.HandleFunc("/whep/{room}/{id}/sse", s.handleSSEGet).Methods("GET")
+	r.HandleFunc("/whep/{room}/{id}/sse", s.handleOptions).Methods("OPTIONS")
+	r.HandleFunc("/whip/{mode}/{room}/{stream}", s.handlePost).Methods("POST")
+	r.HandleFunc("/whip/{mode}/{room}/{stream}", s.handleOptions).Methods("OPTIONS")
+	r.HandleFunc("/whep/{room}/{stream}", s.handleWHEPPost).Methods("POST")
+	for _, prefix := range []string{"/whip", "/whep"} {
+		r.HandleFunc(prefix+"/{room}/{id}", s.handlePatch).Methods("PATCH")
+		r.HandleFunc(prefix+"/{room}/{id}", s.handleDelete).Methods("DELETE")
+		r.HandleFunc(prefix+"/{room}/{id}", s.handleOptions).Methods("OPTIONS")
+	}
+	s.router = r
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link, ETag")
+	switch r.Method {
+	case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		s.router.ServeHTTP(recorder, r)
+		s.metrics.countRequest(r.Method, recorder.status)
+	default:
+		s.router.ServeHTTP(w, r)
+	}
+}
+
+// Events returns the bus of the session events
+func (s *Server) Events() *EventBus {
+	return s.events
+}
+
+// Sessions returns a snapshot of all sessions
+func (s *Server) Sessions() []*Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
+// Session returns the session with the given resource id
+func (s *Server) Session(id string) *Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sessions[id]
+}
+
+// Publisher returns the active publish session of a stream. A stream has up to
+// two publishers, a primary and a backup: the primary is active while it receives
+// packets, else the backup while it does, see IngestTimeout.
+func (s *Server) Publisher(room, stream string) *Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if active, found := s.active[room+"/"+stream]; found {
+		return active
+	}
+	return s.publisher(room, stream, "")
+}
+
+// Viewers counts the subscribe sessions of a stream
+func (s *Server) Viewers(room, stream string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.viewers(room, stream)
+}
+
+func (s *Server) viewers(room, stream string) int {
+	viewers := 0
+	for _, session := range s.sessions {
+		if session.Mode == ModeSubscribe && session.Room == room && session.Stream == stream {
+			viewers++
+		}
+	}
+	return viewers
+}
+
+// publisher returns a publish session of a stream with priority, of any priority when empty
+func (s *Server) publisher(room, stream, priority string) *Session {
+	for _, session := range s.sessions {
+		if session.Mode == ModePublish && session.Room == room && session.Stream == stream &&
+			(priority == "" || session.Priority == priority) {
+			return session
+		}
+	}
+	return nil
+}
+
+// Close stops the failover monitor of the server, the sessions are left open
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// Delete closes and removes a session, it reports whether the session existed
+func (s *Server) Delete(id string) bool {
+	return s.remove(id, "deleted")
+}
+
+// remove closes and removes a session, reason tells the hooks why
+func (s *Server) remove(id, reason string) bool {
+	session := s.Session(id)
+	if session == nil {
+		return false
+	}
+	// the stats are collected before taking the metrics lock, which the
+	// requests wait on, then the traffic of the session moves to the metrics
+	// totals as it is removed
+	stats := session.conn().Stats()
+	s.metrics.lock.Lock()
+	s.lock.Lock()
+	found := s.sessions[id] == session
+	viewers := 0
+	if found {
+		delete(s.sessions, id)
+		viewers = s.viewers(session.Room, session.Stream)
+		s.metrics.removed.add(stats)
+	}
+	s.lock.Unlock()
+	s.metrics.lock.Unlock()
+
+	// removed meanwhile by another call
+	if !found {
+		return false
+	}
+
+	session.conn().Close()
+	log.Printf("%v stream conn removed %v", session.Mode, session.Stream)
+	if s.OnDelete != nil {
+		s.OnDelete(session)
+	}
+	if s.Hooks != nil {
+		s.Hooks.notify(session, reason)
+	}
+	if session.Mode == ModePublish {
+		s.emit(&PublisherGone{Session: session, Reason: reason}, true)
+		s.failover(session.Room, session.Stream)
+	} else {
+		s.emit(&SubscriberLeft{Session: session, Viewers: viewers, Reason: reason}, true)
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	log.Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+// errorStatus is the status code of the response to a request failing with err
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, whip.ErrBadOffer):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, whip.ErrNoPublisher):
+		return http.StatusNotFound
+	case errors.Is(err, whip.ErrUnsupportedCodec):
+		return http.StatusNotAcceptable
+	case errors.Is(err, whip.ErrStreamExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// readBody reads the body of a request, failing with 413 when it is larger than MaxSDPSize
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	limit := s.MaxSDPSize
+	if limit <= 0 {
+		limit = defaultMaxSDPSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read body: %v", err))
+		return nil, false
+	}
+	if int64(len(body)) > limit {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", limit))
+		return nil, false
+	}
+	return body, true
+}
+
+// hasContentType reports whether the Content-Type of a request is one of types
+func hasContentType(r *http.Request, types ...string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	switch vars["mode"] {
+	case ModePublish:
+		s.handlePublish(w, r)
+	case ModeSubscribe:
+		// subscribing through the WHIP path only supports client offers
+		s.handleSubscribe(w, r, "/whip", false)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleWHEPPost(w http.ResponseWriter, r *http.Request) {
+	s.handleSubscribe(w, r, "/whep", true)
+}
+
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	session, body, ok := s.newSession(w, r, ModePublish, "/whip", false)
+	if !ok {
+		return
+	}
+
+	conn, err := s.engine.NewWHIPConn(s.codecs(session)...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("500 - failed to create whip conn: %v", err))
+		return
+	}
+	session.Conn = conn
+
+	s.lock.Lock()
+	replaced := s.publisher(session.Room, session.Stream, session.Priority)
+	if replaced != nil && !s.ReplacePublisher {
+		s.lock.Unlock()
+		conn.Close()
+		writeError(w, http.StatusConflict, fmt.Sprintf("%v: %v", whip.ErrStreamExists, session.Stream))
+		return
+	}
+	s.sessions[session.ID] = session
+	s.lock.Unlock()
+	// a session failing before it is answered, even by a panic, does not hold the stream
+	answered := false
+	defer func() {
+		if !answered {
+			s.Delete(session.ID)
+		}
+	}()
+
+	if !s.accept(w, session, body, s.OnPublish) {
+		return
+	}
+
+	conn.SetMaxBitrate(session.MaxBitrate)
+	start := time.Now()
+	answer, err := conn.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+	s.metrics.observe(s.metrics.offerAnswer, session.Mode, time.Since(start))
+	if err != nil {
+		writeError(w, errorStatus(err), fmt.Sprintf("failed to answer whip conn: %v", err))
+		return
+	}
+	answered = true
+	if replaced != nil {
+		s.remove(replaced.ID, "replaced")
+	}
+	s.failover(session.Room, session.Stream)
+	s.monitorOnce.Do(func() { go s.monitor() })
+	s.writeCreated(w, session, answer)
+}
+
+// handleSubscribe creates a WHEP session, with an empty body and serverOffer
+// the server makes the offer and the player PATCHes its answer
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request, prefix string, serverOffer bool) {
+	if s.OnSubscribe == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, body, ok := s.newSession(w, r, ModeSubscribe, prefix, serverOffer)
+	if !ok {
+		return
+	}
+
+	conn, err := s.engine.NewWHEPConn(s.codecs(session)...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("500 - failed to create whep conn: %v", err))
+		return
+	}
+	session.WHEP = conn
+
+	s.lock.Lock()
+	s.sessions[session.ID] = session
+	s.lock.Unlock()
+	answered := false
+	defer func() {
+		if !answered {
+			s.Delete(session.ID)
+		}
+	}()
+
+	if !s.accept(w, session, body, s.OnSubscribe) {
+		return
+	}
+
+	var desc *webrtc.SessionDescription
+	start := time.Now()
+	if len(body) == 0 && serverOffer {
+		desc, err = conn.CreateOffer()
+	} else {
+		desc, err = conn.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+	}
+	s.metrics.observe(s.metrics.offerAnswer, session.Mode, time.Since(start))
+	if err != nil {
+		writeError(w, errorStatus(err), fmt.Sprintf("failed to negotiate whep conn: %v", err))
+		return
+	}
+	answered = true
+	s.writeCreated(w, session, desc)
+}
+
+// newSession reads the offer and sets up a session without a connection,
+// with serverOffer the offer may be empty
+func (s *Server) newSession(w http.ResponseWriter, r *http.Request, mode, prefix string, serverOffer bool) (*Session, []byte, bool) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	streamId := vars["stream"]
+
+	if !s.authorize(w, r, mode, roomId, streamId) {
+		return nil, nil, false
+	}
+	token := bearerToken(r)
+	maxBitrate := 0
+	if limiter, ok := s.Authorizer.(BitrateLimiter); ok {
+		maxBitrate = limiter.MaxBitrate(token)
+	}
+
+	priority := ""
+	if mode == ModePublish {
+		priority = r.URL.Query().Get("priority")
+		if prioritizer, ok := s.Authorizer.(PriorityAuthorizer); ok {
+			if p := prioritizer.Priority(token); p != "" {
+				priority = p
+			}
+		}
+		switch priority {
+		case "":
+			priority = PriorityPrimary
+		case PriorityPrimary, PriorityBackup:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown priority %q", priority))
+			return nil, nil, false
+		}
+	}
+
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if !(serverOffer && len(body) == 0) && !hasContentType(r, "application/sdp") {
+		writeError(w, http.StatusUnsupportedMediaType, "offer is not application/sdp")
+		return nil, nil, false
+	}
+	log.Printf("Post: mode => %v, roomId => %v, streamId => %v, body = %v", mode, roomId, streamId, string(body))
+
+	return &Session{
+		ID:         mode + "-" + streamId + "-" + util.RandomString(12),
+		Room:       roomId,
+		Stream:     streamId,
+		Mode:       mode,
+		Query:      r.URL.Query(),
+		ClientIP:   clientIP(r),
+		MaxBitrate: maxBitrate,
+		Priority:   priority,
+		prefix:     prefix,
+		token:      token,
+		etag:       newETag(),
+		liveTracks: make(map[*webrtc.TrackRemote]bool),
+		created:    time.Now(),
+	}, body, true
+}
+
+// clientIP returns the address of the peer of the http connection
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) codecs(session *Session) []whip.CodecConfig {
+	if s.Codecs == nil {
+		return nil
+	}
+	return s.Codecs(session.Mode, session.Room, session.Stream)
+}
+
+// accept runs the hooks and the onCreate callback of a registered session and hooks
+// its removal to the connection state, a rejected session is dropped without calling OnDelete
+func (s *Server) accept(w http.ResponseWriter, session *Session, offer []byte, onCreate func(*Session) error) bool {
+	reject := func(code int, err error) bool {
+		s.lock.Lock()
+		delete(s.sessions, session.ID)
+		s.lock.Unlock()
+		session.conn().Close()
+		writeError(w, code, err.Error())
+		return false
+	}
+
+	if s.Hooks != nil {
+		if err := s.Hooks.accept(session, offer); err != nil {
+			return reject(http.StatusForbidden, err)
+		}
+	}
+	if onCreate != nil {
+		if err := onCreate(session); err != nil {
+			return reject(errorStatus(err), err)
+		}
+	}
+
+	session.onConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			session.connectOnce.Do(func() {
+				s.metrics.observe(s.metrics.iceConnect, session.Mode, time.Since(session.created))
+			})
+		}
+		// a disconnected session is kept for the client to restart ice
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			s.remove(session.ID, state.String())
+		}
+	})
+
+	s.watchSession(session)
+	s.emit(&SessionCreated{Session: session}, false)
+	if session.Mode == ModeSubscribe {
+		s.emit(&SubscriberJoined{Session: session, Viewers: s.Viewers(session.Room, session.Stream)}, false)
+	}
+	return true
+}
+
+func (s *Server) writeCreated(w http.ResponseWriter, session *Session, desc *webrtc.SessionDescription) {
+	log.Printf("send %v => %v", desc.Type, desc.SDP)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", session.Location())
+	w.Header().Set("ETag", session.etag)
+	for _, link := range iceServerLinks(session.conn().ICEServers()) {
+		w.Header().Add("Link", link)
+	}
+	if session.Mode == ModeSubscribe {
+		w.Header().Add("Link", sseLink(session))
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(desc.SDP))
+}
+
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	id := vars["id"]
+
+	session := s.Session(id)
+	if session == nil {
+		writeError(w, http.StatusNotFound, "session "+id+" not found")
+		return
+	}
+	if !s.authorize(w, r, session.Mode, session.Room, session.Stream) {
+		return
+	}
+	// a WHEP session also takes the answer to a server offer
+	answer := session.WHEP != nil && hasContentType(r, "application/sdp")
+	if !answer && !hasContentType(r, whip.SDPFragContentType) {
+		writeError(w, http.StatusUnsupportedMediaType, "patch is not "+whip.SDPFragContentType)
+		return
+	}
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("Patch: roomId => %v, resourceId => %v, body = %v", roomId, id, string(body))
+
+	if answer {
+		// the answer to a server offer
+		if err := session.WHEP.SetAnswer(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to set answer: %v", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	frag, err := whip.ParseSDPFrag(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse sdpfrag: %v", err))
+		return
+	}
+
+	session.patchLock.Lock()
+	defer session.patchLock.Unlock()
+
+	// a stale ETag is from before the last ice restart
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != session.etag {
+		writeError(w, http.StatusPreconditionFailed, "ice session "+ifMatch+" has been restarted")
+		return
+	}
+
+	conn := session.conn()
+	if conn.IsICERestart(frag) {
+		s.restartICE(w, session, frag, ifMatch)
+		return
+	}
+
+	if err := conn.Trickle(frag); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("failed to add candidates: %v", err))
+		return
+	}
+
+	// the server candidates gathered after answering are trickled back
+	if local := conn.PendingCandidates(); local != nil {
+		w.Header().Set("Content-Type", whip.SDPFragContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(local.String()))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restartICE answers an ice restart with the sdpfrag of the new ice session
+func (s *Server) restartICE(w http.ResponseWriter, session *Session, frag *whip.SDPFrag, ifMatch string) {
+	if ifMatch == "" {
+		writeError(w, http.StatusPreconditionRequired, "ice restart without If-Match")
+		return
+	}
+
+	local, err := session.conn().RestartICE(frag)
+	if errors.Is(err, whip.ErrICERestartUnsupported) {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, errorStatus(err), fmt.Sprintf("failed to restart ice: %v", err))
+		return
+	}
+	session.etag = newETag()
+	log.Printf("ice restarted for %v", session.ID)
+
+	w.Header().Set("Content-Type", whip.SDPFragContentType)
+	w.Header().Set("ETag", session.etag)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(local.String()))
+}
+
+func newETag() string {
+	return `"` + util.RandomString(16) + `"`
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	id := vars["id"]
+
+	log.Printf("Delete: roomId => %v, resourceId => %v", roomId, id)
+
+	if session := s.Session(id); session != nil && !s.authorize(w, r, session.Mode, session.Room, session.Stream) {
+		return
+	}
+	if !s.Delete(id) {
+		writeError(w, http.StatusNotFound, "session "+id+" not found")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(id + " deleted"))
+}
+
+func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+	w.Header().Set("Accept-Post", "application/sdp")
+	if s.iceServersAllowed(r) {
+		for _, link := range iceServerLinks(s.engine.ICEServers()) {
+			w.Header().Add("Link", link)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// iceServersAllowed reports whether the bearer token of an OPTIONS request is
+// authorized on its stream, the ice servers may carry relay credentials. CORS
+// preflights send no token, they are still answered, without ice servers.
+func (s *Server) iceServersAllowed(r *http.Request) bool {
+	if s.Authorizer == nil {
+		return true
+	}
+	vars := mux.Vars(r)
+	mode, room, stream := vars["mode"], vars["room"], vars["stream"]
+	if session := s.Session(vars["id"]); session != nil {
+		mode, room, stream = session.Mode, session.Room, session.Stream
+	} else if strings.HasPrefix(r.URL.Path, "/whep/") && !strings.HasSuffix(r.URL.Path, "/sse") {
+		// /whep/{room}/{stream} is matched by the resource route
+		mode, stream = ModeSubscribe, vars["id"]
+	}
+	if stream == "" {
+		return false
+	}
+	return s.Authorizer.Authorize(mode, room, stream, bearerToken(r)) == nil
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// sseRel is the Link relation of the WHEP server-sent events extension
+const sseRel = "urn:ietf:params:whep:ext:core:server-sent-events"
+
+const defaultStatsInterval = 5 * time.Second
+
+// whepEvents are the events a subscribe session can ask for
+var whepEvents = []string{"active", "inactive", "layers", "viewercount"}
+
+// Layer is a video track received from a publisher, a simulcast layer when it has a rid
+type Layer struct {
+	RID      string `json:"rid,omitempty"`
+	MimeType string `json:"mime_type"`
+}
+
+// Layers returns the video tracks a publish session is receiving, ordered by rid
+func (s *Session) Layers() []Layer {
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+
+	layers := []Layer{}
+	for track := range s.liveTracks {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			layers = append(layers, Layer{RID: track.RID(), MimeType: track.Codec().MimeType})
+		}
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].RID < layers[j].RID })
+	return layers
+}
+
+func sameLayers(a, b []Layer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sseMessage is a server-sent event with its JSON data
+type sseMessage struct {
+	event string
+	data  interface{}
+}
+
+// eventStream turns the events of the bus into the server-sent events of a client.
+// It keeps the state last sent so that an event is only sent for a change.
+type eventStream interface {
+	// initial returns the events describing the state when the stream starts
+	initial() []sseMessage
+	// translate returns the events sent for e, and whether the stream ends with it
+	translate(e Event) ([]sseMessage, bool)
+	// tick returns the events sent every stats interval
+	tick() []sseMessage
+}
+
+func (s *Server) statsInterval() time.Duration {
+	if s.StatsInterval > 0 {
+		return s.StatsInterval
+	}
+	return defaultStatsInterval
+}
+
+// serveEventStream writes the events of stream as text/event-stream until the
+// client goes away or the stream ends
+func (s *Server) serveEventStream(w http.ResponseWriter, r *http.Request, stream eventStream) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "500 - event streams are not supported")
+		return
+	}
+
+	// subscribing first, no change is missed between the initial state and the events
+	events, cancel := s.events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(messages []sseMessage) bool {
+		if len(messages) == 0 {
+			// a comment keeps proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return false
+			}
+		}
+		for _, m := range messages {
+			data, err := json.Marshal(m.data)
+			if err != nil {
+				log.Printf("event %v: %v", m.event, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.event, data); err != nil {
+				return false
+			}
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !write(stream.initial()) {
+		return
+	}
+	ticker := time.NewTicker(s.statsInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			messages, end := stream.translate(e)
+			if len(messages) > 0 && !write(messages) || end {
+				return
+			}
+		case <-ticker.C:
+			if !write(stream.tick()) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type sessionData struct {
+	ID     string `json:"id"`
+	Room   string `json:"room"`
+	Stream string `json:"stream"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type viewerData struct {
+	Room    string `json:"room,omitempty"`
+	Stream  string `json:"stream,omitempty"`
+	Viewers int    `json:"viewercount"`
+}
+
+type layerData struct {
+	ID     string  `json:"id,omitempty"`
+	Room   string  `json:"room,omitempty"`
+	Stream string  `json:"stream,omitempty"`
+	Layers []Layer `json:"layers"`
+}
+
+type statsData struct {
+	ID     string `json:"id"`
+	Room   string `json:"room"`
+	Stream string `json:"stream"`
+	Mode   string `json:"mode"`
+	// Interval is the time since the previous stats event, in milliseconds
+	Interval      int64  `json:"interval_ms"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+type transferred struct {
+	sent, received uint64
+}
+
+// transportBytes sums the bytes sent and received by the transports of a report
+func transportBytes(report webrtc.StatsReport) transferred {
+	var t transferred
+	for _, stats := range report {
+		if transport, ok := stats.(webrtc.TransportStats); ok {
+			t.sent += transport.BytesSent
+			t.received += transport.BytesReceived
+		}
+	}
+	return t
+}
+
+// serverStream is the stream of /whip/events: publish, unpublish, viewercount,
+// layers and the stats deltas of all sessions
+type serverStream struct {
+	server     *Server
+	publishers map[string]bool
+	viewers    map[string]int
+	layers     map[string][]Layer
+	bytes      map[string]transferred
+	lastTick   time.Time
+}
+
+func newServerStream(s *Server) *serverStream {
+	return &serverStream{
+		server:     s,
+		publishers: make(map[string]bool),
+		viewers:    make(map[string]int),
+		layers:     make(map[string][]Layer),
+		bytes:      make(map[string]transferred),
+		lastTick:   time.Now(),
+	}
+}
+
+func (st *serverStream) initial() []sseMessage {
+	var messages []sseMessage
+	for _, session := range st.server.Sessions() {
+		st.bytes[session.ID] = transportBytes(session.conn().GetStats())
+		if session.Mode != ModePublish {
+			continue
+		}
+		messages = append(messages, st.publish(session)...)
+		messages = append(messages, st.viewerCount(session, st.server.Viewers(session.Room, session.Stream))...)
+		messages = append(messages, st.layerChange(session)...)
+	}
+	return messages
+}
+
+func (st *serverStream) translate(e Event) ([]sseMessage, bool) {
+	switch e := e.(type) {
+	case *SessionCreated:
+		if e.Session.Mode == ModePublish {
+			return st.publish(e.Session), false
+		}
+	case *PublisherGone:
+		if !st.publishers[e.Session.ID] {
+			return nil, false
+		}
+		delete(st.publishers, e.Session.ID)
+		delete(st.layers, e.Session.ID)
+		delete(st.bytes, e.Session.ID)
+		return []sseMessage{{"unpublish", &sessionData{ID: e.Session.ID, Room: e.Session.Room, Stream: e.Session.Stream, Reason: e.Reason}}}, false
+	case *SubscriberJoined:
+		return st.viewerCount(e.Session, e.Viewers), false
+	case *SubscriberLeft:
+		delete(st.bytes, e.Session.ID)
+		return st.viewerCount(e.Session, e.Viewers), false
+	case *TrackStarted:
+		return st.layerChange(e.Session), false
+	case *TrackEnded:
+		return st.layerChange(e.Session), false
+	}
+	return nil, false
+}
+
+func (st *serverStream) publish(session *Session) []sseMessage {
+	if st.publishers[session.ID] {
+		return nil
+	}
+	st.publishers[session.ID] = true
+	return []sseMessage{{"publish", &sessionData{ID: session.ID, Room: session.Room, Stream: session.Stream}}}
+}
+
+func (st *serverStream) viewerCount(session *Session, viewers int) []sseMessage {
+	key := session.Room + "/" + session.Stream
+	if last, found := st.viewers[key]; found && last == viewers {
+		return nil
+	}
+	st.viewers[key] = viewers
+	return []sseMessage{{"viewercount", &viewerData{Room: session.Room, Stream: session.Stream, Viewers: viewers}}}
+}
+
+func (st *serverStream) layerChange(session *Session) []sseMessage {
+	if !st.publishers[session.ID] {
+		return nil
+	}
+	layers := session.Layers()
+	if sameLayers(st.layers[session.ID], layers) {
+		return nil
+	}
+	st.layers[session.ID] = layers
+	return []sseMessage{{"layers", &layerData{ID: session.ID, Room: session.Room, Stream: session.Stream, Layers: layers}}}
+}
+
+// tick sends the bytes transferred by every session since the previous tick
+func (st *serverStream) tick() []sseMessage {
+	now := time.Now()
+	interval := now.Sub(st.lastTick).Milliseconds()
+	st.lastTick = now
+
+	var messages []sseMessage
+	for _, session := range st.server.Sessions() {
+		t := transportBytes(session.conn().GetStats())
+		last := st.bytes[session.ID]
+		st.bytes[session.ID] = t
+		if t.sent < last.sent || t.received < last.received {
+			// the counters restarted with the transport
+			last = transferred{}
+		}
+		if t == last {
+			continue
+		}
+		messages = append(messages, sseMessage{"stats", &statsData{
+			ID:            session.ID,
+			Room:          session.Room,
+			Stream:        session.Stream,
+			Mode:          session.Mode,
+			Interval:      interval,
+			BytesSent:     t.sent - last.sent,
+			BytesReceived: t.received - last.received,
+		}})
+	}
+	return messages
+}
+
+// whepStream is the stream of the WHEP server-sent events extension of a
+// subscribe session, about the stream it plays
+type whepStream struct {
+	server    *Server
+	session   *Session
+	events    map[string]bool
+	publisher *Session
+	viewers   int
+	layers    []Layer
+}
+
+func (st *whepStream) initial() []sseMessage {
+	st.viewers = -1
+	var messages []sseMessage
+	if pub := st.server.Publisher(st.session.Room, st.session.Stream); pub != nil {
+		messages = st.active(pub)
+	} else {
+		messages = st.send("inactive", struct{}{})
+	}
+	messages = append(messages, st.viewerCount(st.server.Viewers(st.session.Room, st.session.Stream))...)
+	return append(messages, st.layerChange()...)
+}
+
+func (st *whepStream) translate(e Event) ([]sseMessage, bool) {
+	session := e.session()
+	if session == st.session {
+		_, left := e.(*SubscriberLeft)
+		return nil, left
+	}
+	if session.Room != st.session.Room || session.Stream != st.session.Stream {
+		return nil, false
+	}
+
+	switch e := e.(type) {
+	case *SessionCreated:
+		// a publisher replacing the current one takes over, see Server.ReplacePublisher
+		if session.Mode == ModePublish && (st.publisher == nil || session.Priority == st.publisher.Priority) {
+			return st.switchTo(session), false
+		}
+	case *PublisherActivated:
+		// the backup or the primary publisher took over
+		return st.switchTo(session), false
+	case *PublisherGone:
+		if session == st.publisher {
+			st.publisher = nil
+			st.layers = nil
+			return st.send("inactive", struct{}{}), false
+		}
+	case *SubscriberJoined:
+		return st.viewerCount(e.Viewers), false
+	case *SubscriberLeft:
+		return st.viewerCount(e.Viewers), false
+	case *TrackStarted, *TrackEnded:
+		if session == st.publisher {
+			return st.layerChange(), false
+		}
+	}
+	return nil, false
+}
+
+func (st *whepStream) tick() []sseMessage {
+	return nil
+}
+
+func (st *whepStream) send(event string, data interface{}) []sseMessage {
+	if !st.events[event] {
+		return nil
+	}
+	return []sseMessage{{event, data}}
+}
+
+func (st *whepStream) active(pub *Session) []sseMessage {
+	st.publisher = pub
+	return st.send("active", struct{}{})
+}
+
+// switchTo makes pub the publisher of the stream, its layers are sent again
+func (st *whepStream) switchTo(pub *Session) []sseMessage {
+	messages := st.active(pub)
+	st.layers = nil
+	return append(messages, st.layerChange()...)
+}
+
+func (st *whepStream) viewerCount(viewers int) []sseMessage {
+	if viewers == st.viewers {
+		return nil
+	}
+	st.viewers = viewers
+	return st.send("viewercount", &viewerData{Viewers: viewers})
+}
+
+func (st *whepStream) layerChange() []sseMessage {
+	if st.publisher == nil {
+		return nil
+	}
+	layers := st.publisher.Layers()
+	if sameLayers(st.layers, layers) {
+		return nil
+	}
+	st.layers = layers
+	return st.send("layers", &layerData{Layers: layers})
+}
+
+// sseLink is the Link advertising the event stream of a subscribe session
+func sseLink(session *Session) string {
+	return "</whep/" + session.Room + "/" + session.ID + "/sse>; rel=\"" + sseRel + "\"; events=\"" + strings.Join(whepEvents, ",") + "\""
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	// the events expose the resource ids of all the sessions
+	if !s.authorize(w, r, ModeEvents, "", "") {
+		return
+	}
+	s.serveEventStream(w, r, newServerStream(s))
+}
+
+// subscribeSession returns the subscribe session of the request, answering 404 when there is none
+func (s *Server) subscribeSession(w http.ResponseWriter, r *http.Request) *Session {
+	session := s.Session(mux.Vars(r)["id"])
+	if session == nil || session.Mode != ModeSubscribe {
+		http.NotFound(w, r)
+		return nil
+	}
+	return session
+}
+
+// handleSSEPost selects the events of a subscribe session from a JSON array of
+// event names, all of them for an empty body, and returns the event stream url
+func (s *Server) handleSSEPost(w http.ResponseWriter, r *http.Request) {
+	session := s.subscribeSession(w, r)
+	if session == nil || !s.authorize(w, r, session.Mode, session.Room, session.Stream) {
+		return
+	}
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// a fresh slice, unmarshaling into whepEvents would overwrite them
+	var requested []string
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &requested); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse events: %v", err))
+			return
+		}
+	} else {
+		requested = whepEvents
+	}
+	events := make(map[string]bool)
+	for _, event := range requested {
+		if contains(whepEvents, event) {
+			events[event] = true
+		}
+	}
+	if len(events) == 0 {
+		writeError(w, http.StatusBadRequest, "none of the events "+strings.Join(requested, ",")+" is supported")
+		return
+	}
+
+	session.patchLock.Lock()
+	session.sseEvents = events
+	session.patchLock.Unlock()
+
+	w.Header().Set("Location", session.Location()+"/sse")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleSSEGet streams the events of a subscribe session. An EventSource cannot
+// send an Authorization header, the stream is only known by the session url.
+func (s *Server) handleSSEGet(w http.ResponseWriter, r *http.Request) {
+	session := s.subscribeSession(w, r)
+	if session == nil {
+		return
+	}
+
+	session.patchLock.Lock()
+	events := session.sseEvents
+	session.patchLock.Unlock()
+	if events == nil {
+		events = make(map[string]bool)
+		for _, event := range whepEvents {
+			events[event] = true
+		}
+	}
+	s.serveEventStream(w, r, &whepStream{server: s, session: session, events: events})
+}
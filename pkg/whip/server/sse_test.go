@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rtcd/whip/pkg/whip"
+)
+
+func TestSSEPost(t *testing.T) {
+	engine, err := whip.NewEngine(whip.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(engine)
+	defer s.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		s.sessions[id] = &Session{ID: id, Room: "live", Stream: "s", Mode: ModeSubscribe, prefix: "/whep"}
+	}
+
+	tests := []struct {
+		session string
+		body    string
+		status  int
+		events  map[string]bool
+	}{
+		{"a", `["layers"]`, http.StatusCreated, map[string]bool{"layers": true}},
+		// the selection of a session leaves the events of the others
+		{"b", `["active"]`, http.StatusCreated, map[string]bool{"active": true}},
+		{"c", ``, http.StatusCreated, map[string]bool{"active": true, "inactive": true, "layers": true, "viewercount": true}},
+		{"c", `["active","unknown"]`, http.StatusCreated, map[string]bool{"active": true}},
+		{"c", `["unknown"]`, http.StatusBadRequest, map[string]bool{"active": true}},
+		{"c", `{"active":true}`, http.StatusBadRequest, map[string]bool{"active": true}},
+		{"d", `["active"]`, http.StatusNotFound, nil},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/whep/live/"+test.session+"/sse", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%v %v: got status %v, want %v", test.session, test.body, w.Code, test.status)
+		}
+		if test.status == http.StatusCreated && w.Header().Get("Location") != "/whep/live/"+test.session+"/sse" {
+			t.Errorf("%v %v: got location %q", test.session, test.body, w.Header().Get("Location"))
+		}
+		if session := s.Session(test.session); session != nil && !reflect.DeepEqual(session.sseEvents, test.events) {
+			t.Errorf("%v %v: got events %v, want %v", test.session, test.body, session.sseEvents, test.events)
+		}
+	}
+
+	if link := sseLink(s.Session("a")); !strings.Contains(link, `events="active,inactive,layers,viewercount"`) {
+		t.Errorf("got link %v", link)
+	}
+}
@@ -0,0 +1,452 @@
+package whip
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rateWindow is the period over which bitrates and frame rates are measured
+const rateWindow = time.Second
+
+// Stats is a snapshot of the statistics of a connection
+type Stats struct {
+	Timestamp time.Time `json:"timestamp"`
+	// BitrateIn and BitrateOut sum the bitrates of the received and sent tracks
+	BitrateIn  int `json:"bitrate_in"`
+	BitrateOut int `json:"bitrate_out"`
+	// BytesReceived and BytesSent count all the bytes of the ICE transport
+	BytesReceived uint64 `json:"bytes_received"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	// RTT is the round trip time of the selected candidate pair, in seconds
+	RTT                   float64      `json:"rtt"`
+	SelectedCandidatePair string       `json:"selected_candidate_pair,omitempty"`
+	Tracks                []TrackStats `json:"tracks"`
+	// Totals count the RTP of all the tracks of the connection, the removed ones included
+	Totals RTPTotals `json:"totals"`
+}
+
+// RTPTotals are the cumulative counters of the RTP streams of a connection,
+// they never decrease while the connection lives
+type RTPTotals struct {
+	BytesReceived   uint64 `json:"bytes_received"`
+	BytesSent       uint64 `json:"bytes_sent"`
+	PacketsReceived uint64 `json:"packets_received"`
+	PacketsSent     uint64 `json:"packets_sent"`
+	// PLIsSent are sent about the received tracks, PLIsReceived about the sent ones
+	PLIsSent     uint64 `json:"plis_sent"`
+	PLIsReceived uint64 `json:"plis_received"`
+}
+
+// TrackStats is a snapshot of the statistics of an RTP stream of a connection
+type TrackStats struct {
+	ID    string `json:"id,omitempty"`
+	RID   string `json:"rid,omitempty"`
+	Kind  string `json:"kind"`
+	Codec string `json:"codec"`
+	SSRC  uint32 `json:"ssrc"`
+	// Direction is inbound for a received track and outbound for a sent one
+	Direction string `json:"direction"`
+	// Bitrate, in bits per second, and FrameRate are measured over the last second
+	Bitrate   int     `json:"bitrate"`
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	Packets   uint64  `json:"packets"`
+	Bytes     uint64  `json:"bytes"`
+	// PacketsLost and Jitter, in seconds, are those seen by the receiver of the
+	// track, as reported by the player for a sent track
+	PacketsLost int64   `json:"packets_lost"`
+	Jitter      float64 `json:"jitter"`
+	// RTT, in seconds, is computed from the receiver reports of a sent track
+	RTT float64 `json:"rtt,omitempty"`
+	// NACKs, PLIs and FIRs count the feedback sent by the receiver of the track
+	NACKs uint32 `json:"nacks"`
+	PLIs  uint32 `json:"plis"`
+	FIRs  uint32 `json:"firs"`
+}
+
+// statsInterceptor counts the RTP and RTCP packets of a connection per SSRC.
+// It has to come first in the interceptor registry, so that the feedback
+// written by the interceptors registered after it goes through it.
+type statsInterceptor struct {
+	interceptor.NoOp
+	lock    sync.Mutex
+	streams map[uint32]*streamStats
+	// unbound counts the streams no longer bound, pion unbinds the track of a removed sender
+	unbound RTPTotals
+}
+
+func newStatsInterceptor() *statsInterceptor {
+	return &statsInterceptor{streams: make(map[uint32]*streamStats)}
+}
+
+// NewInterceptor implements interceptor.Factory, there is one statsInterceptor per connection
+func (i *statsInterceptor) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *statsInterceptor) bind(info *interceptor.StreamInfo, inbound bool) *streamStats {
+	stream := &streamStats{
+		ssrc:      info.SSRC,
+		inbound:   inbound,
+		mimeType:  info.MimeType,
+		clockRate: info.ClockRate,
+	}
+	i.lock.Lock()
+	if previous := i.streams[info.SSRC]; previous != nil {
+		previous.addTo(&i.unbound)
+	}
+	i.streams[info.SSRC] = stream
+	i.lock.Unlock()
+	return stream
+}
+
+func (i *statsInterceptor) unbind(info *interceptor.StreamInfo) {
+	i.lock.Lock()
+	if stream := i.streams[info.SSRC]; stream != nil {
+		stream.addTo(&i.unbound)
+		delete(i.streams, info.SSRC)
+	}
+	i.lock.Unlock()
+}
+
+// BindRemoteStream counts the packets of a received track
+func (i *statsInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	stream := i.bind(info, true)
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		header := &rtp.Header{}
+		if _, err := header.Unmarshal(b[:n]); err == nil {
+			i.lock.Lock()
+			stream.onPacket(time.Now(), header, n)
+			i.lock.Unlock()
+		}
+		return n, attr, nil
+	})
+}
+
+// UnbindRemoteStream forgets a received track
+func (i *statsInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.unbind(info)
+}
+
+// BindLocalStream counts the packets of a sent track
+func (i *statsInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := i.bind(info, false)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err == nil {
+			i.lock.Lock()
+			stream.onPacket(time.Now(), header, header.MarshalSize()+len(payload))
+			i.lock.Unlock()
+		}
+		return n, err
+	})
+}
+
+// UnbindLocalStream forgets a sent track
+func (i *statsInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.unbind(info)
+}
+
+// BindRTCPReader counts the feedback about the sent tracks
+func (i *statsInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		if pkts, err := rtcp.Unmarshal(b[:n]); err == nil {
+			i.onRTCP(time.Now(), pkts, false)
+		}
+		return n, attr, nil
+	})
+}
+
+// BindRTCPWriter counts the feedback about the received tracks
+func (i *statsInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(pkts, a)
+		if err == nil {
+			i.onRTCP(time.Now(), pkts, true)
+		}
+		return n, err
+	})
+}
+
+// onRTCP counts the feedback about the streams, sent is true for the packets
+// written by the connection, which are about the received tracks
+func (i *statsInterceptor) onRTCP(now time.Time, pkts []rtcp.Packet, sent bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// feedback is sent about received tracks and received about sent tracks
+	feedback := func(ssrc uint32) *streamStats {
+		if stream := i.streams[ssrc]; stream != nil && stream.inbound == sent {
+			return stream
+		}
+		return nil
+	}
+
+	for _, pkt := range pkts {
+		switch pkt := pkt.(type) {
+		case *rtcp.TransportLayerNack:
+			if stream := feedback(pkt.MediaSSRC); stream != nil {
+				stream.nacks++
+			}
+		case *rtcp.PictureLossIndication:
+			if stream := feedback(pkt.MediaSSRC); stream != nil {
+				stream.plis++
+			}
+		case *rtcp.FullIntraRequest:
+			for _, entry := range pkt.FIR {
+				if stream := feedback(entry.SSRC); stream != nil {
+					stream.firs++
+				}
+			}
+		case *rtcp.ReceiverReport:
+			if !sent {
+				i.onReports(now, pkt.Reports)
+			}
+		case *rtcp.SenderReport:
+			if !sent {
+				i.onReports(now, pkt.Reports)
+			}
+		}
+	}
+}
+
+// onReports keeps the loss, jitter and round trip time reported about the sent tracks
+func (i *statsInterceptor) onReports(now time.Time, reports []rtcp.ReceptionReport) {
+	for _, report := range reports {
+		stream := i.streams[report.SSRC]
+		if stream == nil || stream.inbound {
+			continue
+		}
+		stream.lost = int64(report.TotalLost)
+		if stream.clockRate > 0 {
+			stream.jitter = float64(report.Jitter) / float64(stream.clockRate)
+		}
+		if report.LastSenderReport != 0 {
+			// in 1/65536 seconds, the middle 32 bits of the NTP timestamps
+			rtt := compactNTP(now) - report.LastSenderReport - report.Delay
+			if int32(rtt) >= 0 {
+				stream.rtt = float64(rtt) / 65536
+			}
+		}
+	}
+}
+
+// compactNTP returns the middle 32 bits of the NTP timestamp of t
+func compactNTP(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32((seconds<<32 | fraction) >> 16)
+}
+
+// snapshot returns the statistics of the bound streams and the totals of all the streams
+func (i *statsInterceptor) snapshot(now time.Time) ([]TrackStats, RTPTotals) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	tracks := make([]TrackStats, 0, len(i.streams))
+	totals := i.unbound
+	for _, stream := range i.streams {
+		tracks = append(tracks, stream.snapshot(now))
+		stream.addTo(&totals)
+	}
+	sort.Slice(tracks, func(a, b int) bool { return tracks[a].SSRC < tracks[b].SSRC })
+	return tracks, totals
+}
+
+// lastReceived is the time of the last packet received on any stream
+func (i *statsInterceptor) lastReceived() time.Time {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var last time.Time
+	for _, stream := range i.streams {
+		if stream.inbound && stream.lastPacket.After(last) {
+			last = stream.lastPacket
+		}
+	}
+	return last
+}
+
+// streamStats are the counters of an RTP stream
+type streamStats struct {
+	ssrc      uint32
+	inbound   bool
+	mimeType  string
+	clockRate uint32
+
+	packets    uint64
+	bytes      uint64
+	lastPacket time.Time
+
+	// sequence numbers and transit times of a received stream
+	started      bool
+	baseSeq      int64
+	maxSeq       int64
+	firstArrival time.Time
+	lastTransit  uint32
+	transitSet   bool
+	jitterUnits  float64
+
+	// loss, jitter and rtt reported by the receiver of a sent stream
+	lost   int64
+	jitter float64
+	rtt    float64
+
+	nacks uint32
+	plis  uint32
+	firs  uint32
+
+	windowStart  time.Time
+	windowBytes  uint64
+	windowFrames int
+	bitrate      int
+	frameRate    float64
+}
+
+func (s *streamStats) onPacket(now time.Time, header *rtp.Header, size int) {
+	s.packets++
+	s.bytes += uint64(size)
+	s.lastPacket = now
+
+	// the marker bit ends a video frame
+	s.windowBytes += uint64(size)
+	if header.Marker && strings.HasPrefix(s.mimeType, "video/") {
+		s.windowFrames++
+	}
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	} else if elapsed := now.Sub(s.windowStart); elapsed >= rateWindow {
+		s.bitrate = int(float64(s.windowBytes*8) / elapsed.Seconds())
+		s.frameRate = float64(s.windowFrames) / elapsed.Seconds()
+		s.windowStart = now
+		s.windowBytes = 0
+		s.windowFrames = 0
+	}
+
+	if !s.inbound {
+		return
+	}
+
+	// sequence numbers are extended past their 16 bits to count the lost packets
+	if !s.started {
+		s.started = true
+		s.baseSeq = int64(header.SequenceNumber)
+		s.maxSeq = s.baseSeq
+		s.firstArrival = now
+	} else if seq := s.maxSeq + int64(int16(header.SequenceNumber-uint16(s.maxSeq))); seq > s.maxSeq {
+		s.maxSeq = seq
+	}
+
+	// interarrival jitter of RFC 3550, in timestamp units
+	if s.clockRate > 0 {
+		arrival := uint32(now.Sub(s.firstArrival).Seconds() * float64(s.clockRate))
+		transit := arrival - header.Timestamp
+		if s.transitSet {
+			d := int32(transit - s.lastTransit)
+			if d < 0 {
+				d = -d
+			}
+			s.jitterUnits += (float64(d) - s.jitterUnits) / 16
+		}
+		s.lastTransit = transit
+		s.transitSet = true
+	}
+}
+
+// addTo adds the counters of the stream to totals
+func (s *streamStats) addTo(totals *RTPTotals) {
+	if s.inbound {
+		totals.BytesReceived += s.bytes
+		totals.PacketsReceived += s.packets
+		totals.PLIsSent += uint64(s.plis)
+	} else {
+		totals.BytesSent += s.bytes
+		totals.PacketsSent += s.packets
+		totals.PLIsReceived += uint64(s.plis)
+	}
+}
+
+func (s *streamStats) snapshot(now time.Time) TrackStats {
+	t := TrackStats{
+		Kind:      strings.SplitN(s.mimeType, "/", 2)[0],
+		Codec:     s.mimeType,
+		SSRC:      s.ssrc,
+		Direction: "outbound",
+		Packets:   s.packets,
+		Bytes:     s.bytes,
+		NACKs:     s.nacks,
+		PLIs:      s.plis,
+		FIRs:      s.firs,
+	}
+	// the rates of a stream that stopped are no longer updated
+	if now.Sub(s.lastPacket) < 2*rateWindow {
+		t.Bitrate = s.bitrate
+		t.FrameRate = s.frameRate
+	}
+
+	if !s.inbound {
+		t.PacketsLost = s.lost
+		t.Jitter = s.jitter
+		t.RTT = s.rtt
+		return t
+	}
+	t.Direction = "inbound"
+	if s.started {
+		if lost := s.maxSeq - s.baseSeq + 1 - int64(s.packets); lost > 0 {
+			t.PacketsLost = lost
+		}
+	}
+	if s.clockRate > 0 {
+		t.Jitter = s.jitterUnits / float64(s.clockRate)
+	}
+	return t
+}
+
+// stats returns a snapshot of the statistics of the connection, its tracks
+// are only known by their SSRC
+func (p *peer) stats() *Stats {
+	now := time.Now()
+	stats := &Stats{Timestamp: now}
+	stats.Tracks, stats.Totals = p.statsInterceptor.snapshot(now)
+
+	for _, s := range p.pc.GetStats() {
+		switch s := s.(type) {
+		case webrtc.TransportStats:
+			stats.BytesSent += s.BytesSent
+			stats.BytesReceived += s.BytesReceived
+		case webrtc.ICECandidatePairStats:
+			if s.Nominated && s.State == webrtc.StatsICECandidatePairStateSucceeded {
+				stats.RTT = s.CurrentRoundTripTime
+			}
+		}
+	}
+
+	p.pairLock.Lock()
+	if p.selectedPair != nil {
+		stats.SelectedCandidatePair = p.selectedPair.String()
+	}
+	p.pairLock.Unlock()
+
+	for _, track := range stats.Tracks {
+		if track.Direction == "inbound" {
+			stats.BitrateIn += track.Bitrate
+		} else {
+			stats.BitrateOut += track.Bitrate
+		}
+	}
+	return stats
+}
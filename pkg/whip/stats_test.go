@@ -0,0 +1,62 @@
+package whip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestStatsTotals(t *testing.T) {
+	i := newStatsInterceptor()
+	video := &interceptor.StreamInfo{SSRC: 1, MimeType: "video/VP8", ClockRate: 90000}
+	audio := &interceptor.StreamInfo{SSRC: 2, MimeType: "audio/opus", ClockRate: 48000}
+	sink := interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		return header.MarshalSize() + len(payload), nil
+	})
+	rtcpSource := interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		pkt, _ := (&rtcp.PictureLossIndication{MediaSSRC: 1}).Marshal()
+		return copy(b, pkt), a, nil
+	})
+
+	write := func(writer interceptor.RTPWriter, ssrc uint32, n int) {
+		for seq := 0; seq < n; seq++ {
+			if _, err := writer.Write(&rtp.Header{Version: 2, SSRC: ssrc, SequenceNumber: uint16(seq)}, make([]byte, 100), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(i.BindLocalStream(video, sink), 1, 3)
+	write(i.BindLocalStream(audio, sink), 2, 2)
+	if _, _, err := i.BindRTCPReader(rtcpSource).Read(make([]byte, 1500), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64((&rtp.Header{}).MarshalSize() + 100)
+	want := RTPTotals{BytesSent: 5 * size, PacketsSent: 5, PLIsReceived: 1}
+	tracks, totals := i.snapshot(time.Now())
+	if len(tracks) != 2 || totals != want {
+		t.Fatalf("got %v tracks and totals %+v, want %+v", len(tracks), totals, want)
+	}
+
+	// pion unbinds the stream of a removed track, its counts stay in the totals
+	i.UnbindLocalStream(video)
+	tracks, totals = i.snapshot(time.Now())
+	if len(tracks) != 1 || totals != want {
+		t.Fatalf("got %v tracks and totals %+v after unbind, want %+v", len(tracks), totals, want)
+	}
+
+	// a stream bound again with the same ssrc starts from zero, the totals go on
+	write(i.BindLocalStream(video, sink), 1, 1)
+	want.BytesSent += size
+	want.PacketsSent++
+	tracks, totals = i.snapshot(time.Now())
+	if len(tracks) != 2 || totals != want {
+		t.Fatalf("got %v tracks and totals %+v after rebind, want %+v", len(tracks), totals, want)
+	}
+	if tracks[0].Packets != 1 {
+		t.Errorf("got %v packets for the rebound stream", tracks[0].Packets)
+	}
+}
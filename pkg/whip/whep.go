@@ -0,0 +1,279 @@
+package whip
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// SignalingLabel is the label of the data channel renegotiating a WHEPConn whose
+// tracks changed. The server sends its offers on it as the JSON of a session
+// description, {"type":"offer","sdp":"..."}, and the player answers in the same
+// format on the channel or with a PATCH of the resource. The player opens the
+// channel in the client-offer mode, the server in the server-offer mode.
+const SignalingLabel = "whep-signaling"
+
+// WHEPConn is an egress connection sending tracks to a WHEP player. It supports
+// both the client-offer mode, where the player POSTs an offer that is answered
+// with Offer, and the server-offer mode, where CreateOffer makes the offer and
+// the player's answer is applied with SetAnswer.
+type WHEPConn struct {
+	*peer
+	// OnKeyframeRequest is called when the player asks for a keyframe of a track with
+	// a PLI or FIR, and for the video tracks once they are negotiated and connected
+	OnKeyframeRequest func(track webrtc.TrackLocal)
+
+	lock      sync.Mutex
+	signaling *webrtc.DataChannel
+	// pending is set when the tracks changed since the last offer
+	pending bool
+	// added are the tracks added since the last offer, offered those of the last offer
+	added   []webrtc.TrackLocal
+	offered []webrtc.TrackLocal
+}
+
+// NewWHEPConn creates a WHEPConn using the settings of the engine. The engine
+// codecs are used unless codecs are given to override them for this connection.
+func (e *Engine) NewWHEPConn(codecs ...CodecConfig) (*WHEPConn, error) {
+	// the FanoutTracks answer the NACKs of the player
+	peer, err := e.newPeer(codecs, false)
+	if err != nil {
+		return nil, err
+	}
+	whep := &WHEPConn{peer: peer}
+	peer.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == SignalingLabel {
+			whep.setSignaling(dc)
+		}
+	})
+	// a player starts decoding from a keyframe
+	peer.onConnected = func() {
+		for _, sender := range peer.pc.GetSenders() {
+			if track := sender.Track(); track != nil && track.Kind() == webrtc.RTPCodecTypeVideo {
+				whep.requestKeyframe(track)
+			}
+		}
+	}
+	return whep, nil
+}
+
+// AddTrack adds a sendonly transceiver for track. The tracks added after Offer or
+// CreateOffer are offered to the player on the signaling data channel.
+// The lost packets are only retransmitted for FanoutTracks.
+func (w *WHEPConn) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	transceiver, err := w.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sender := transceiver.Sender()
+	go w.readRTCP(sender, track)
+
+	w.lock.Lock()
+	w.added = append(w.added, track)
+	w.lock.Unlock()
+	w.renegotiate()
+	return sender, nil
+}
+
+// RemoveTrack stops sending track, renegotiating as AddTrack
+func (w *WHEPConn) RemoveTrack(track webrtc.TrackLocal) error {
+	for _, sender := range w.pc.GetSenders() {
+		if sender.Track() == track {
+			if err := w.pc.RemoveTrack(sender); err != nil {
+				return err
+			}
+			w.renegotiate()
+			return nil
+		}
+	}
+	return ErrTrackNotFound
+}
+
+// Tracks returns the tracks sent to the player
+func (w *WHEPConn) Tracks() []webrtc.TrackLocal {
+	var tracks []webrtc.TrackLocal
+	for _, sender := range w.pc.GetSenders() {
+		if track := sender.Track(); track != nil {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+func (w *WHEPConn) setSignaling(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		w.lock.Lock()
+		w.signaling = dc
+		w.lock.Unlock()
+		w.renegotiate()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(msg.Data, &answer); err != nil || answer.Type != webrtc.SDPTypeAnswer {
+			log.Printf("unexpected signaling message: %s", msg.Data)
+			return
+		}
+		if err := w.SetAnswer(answer); err != nil {
+			log.Printf("renegotiation answer: %v", err)
+		}
+	})
+}
+
+// renegotiate offers the changed tracks to the player once the connection is
+// negotiated and the signaling channel is open, and the previous offer answered
+func (w *WHEPConn) renegotiate() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// the tracks added before negotiating are part of the first offer or answer
+	if w.pc.LocalDescription() == nil && w.pc.RemoteDescription() == nil {
+		w.added = nil
+		return
+	}
+	w.pending = true
+	if w.signaling == nil || w.pc.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
+	w.pending = false
+
+	offer, err := w.pc.CreateOffer(nil)
+	if err == nil {
+		err = w.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("renegotiation offer: %v", err)
+		return
+	}
+	msg, err := json.Marshal(w.pc.LocalDescription())
+	if err == nil {
+		err = w.signaling.SendText(string(msg))
+	}
+	if err != nil {
+		log.Printf("send renegotiation offer: %v", err)
+		return
+	}
+	w.offered, w.added = w.added, nil
+}
+
+// negotiated requests the keyframes of the tracks just negotiated, and renegotiates
+// the tracks changed meanwhile
+func (w *WHEPConn) negotiated() {
+	w.lock.Lock()
+	offered, pending := w.offered, w.pending
+	w.offered = nil
+	w.lock.Unlock()
+
+	// the first negotiated tracks get theirs once connected
+	if w.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		for _, track := range offered {
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				w.requestKeyframe(track)
+			}
+		}
+	}
+	if pending {
+		w.renegotiate()
+	}
+}
+
+// readRTCP reads the feedback of the player about a track until the sender is
+// stopped, the feedback about a FanoutTrack is handled by the track
+func (w *WHEPConn) readRTCP(sender *webrtc.RTPSender, track webrtc.TrackLocal) {
+	fanout, _ := track.(*FanoutTrack)
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if fanout != nil {
+			fanout.handleRTCP(pkts)
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				w.requestKeyframe(track)
+			}
+		}
+	}
+}
+
+func (w *WHEPConn) requestKeyframe(track webrtc.TrackLocal) {
+	if w.OnKeyframeRequest != nil {
+		w.OnKeyframeRequest(track)
+	}
+}
+
+// Stats returns a snapshot of the statistics of the connection and of the tracks it sends
+func (w *WHEPConn) Stats() *Stats {
+	stats := w.stats()
+	for _, sender := range w.pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			for i := range stats.Tracks {
+				if stats.Tracks[i].SSRC == uint32(encoding.SSRC) {
+					stats.Tracks[i].ID = track.ID()
+				}
+			}
+		}
+	}
+	return stats
+}
+
+// Offer answers the offer of a player, gathering candidates for at most the
+// gather timeout of the engine
+func (w *WHEPConn) Offer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	ctx, cancel := w.gatherContext()
+	defer cancel()
+	return w.OfferContext(ctx, offer)
+}
+
+// OfferContext answers the offer of a player once ICE gathering is complete
+// or ctx is done, the candidates gathered later are returned by PendingCandidates
+func (w *WHEPConn) OfferContext(ctx context.Context, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	answer, err := w.answer(ctx, offer)
+	if err == nil {
+		w.negotiated()
+	}
+	return answer, err
+}
+
+// CreateOffer creates the offer of the server-offer mode, gathering candidates
+// for at most the gather timeout of the engine. It opens the signaling data channel.
+func (w *WHEPConn) CreateOffer() (*webrtc.SessionDescription, error) {
+	dc, err := w.pc.CreateDataChannel(SignalingLabel, nil)
+	if err != nil {
+		w.pc.Close()
+		return nil, err
+	}
+	w.setSignaling(dc)
+
+	offer, err := w.pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("CreateOffer err %v ", err)
+		w.pc.Close()
+		return nil, err
+	}
+	ctx, cancel := w.gatherContext()
+	defer cancel()
+	return w.setLocalDescription(ctx, offer)
+}
+
+// SetAnswer applies the answer of the player to an offer made by CreateOffer
+// or sent on the signaling data channel
+func (w *WHEPConn) SetAnswer(answer webrtc.SessionDescription) error {
+	if err := w.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("SetRemoteDescription err %v ", err)
+		return err
+	}
+	w.negotiated()
+	return nil
+}
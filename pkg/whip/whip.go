@@ -1,11 +1,11 @@
 package whip
 
 import (
+	"context"
 	"log"
-	"net"
+	"sync"
+	"time"
 
-	"github.com/pion/interceptor"
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -14,157 +14,53 @@ type Candidates struct {
 	NAT1To1IPs []string `mapstructure:"nat1to1"`
 }
 
-// ICEServerConfig defines parameters for ice servers
+// ICEServerConfig defines parameters for ice servers.
+// When Secret is set, time-limited credentials valid for TTL seconds are minted
+// per connection with the TURN REST API scheme, and Username, if set, is used as the user id.
 type ICEServerConfig struct {
 	URLs       []string `mapstructure:"urls"`
 	Username   string   `mapstructure:"username"`
 	Credential string   `mapstructure:"credential"`
+	Secret     string   `mapstructure:"secret"`
+	TTL        int      `mapstructure:"ttl"`
 }
 
-// WebRTCConfig defines parameters for ice
+// WebRTCConfig defines parameters for ice.
+// GatherTimeout, in milliseconds, bounds the ICE gathering done before answering,
+// the candidates gathered later are trickled. Zero waits for gathering to complete.
 type WebRTCConfig struct {
 	ICESinglePort int               `mapstructure:"singleport"`
 	ICEPortRange  []uint16          `mapstructure:"portrange"`
 	ICEServers    []ICEServerConfig `mapstructure:"iceserver"`
 	Candidates    Candidates        `mapstructure:"candidates"`
+	GatherTimeout int               `mapstructure:"gathertimeout"`
 }
 
 // Config for base SFU
 type Config struct {
-	WebRTC WebRTCConfig `mapstructure:"webrtc"`
-}
-
-var (
-	webrtcSettings webrtc.SettingEngine
-)
-
-const (
-	mimeTypeH264 = "video/h264"
-	mimeTypeOpus = "audio/opus"
-	mimeTypeVP8  = "video/vp8"
-	mimeTypeVP9  = "video/vp9"
-	mineTypePCMA = "audio/PCMA"
-)
-
-func Init(c Config) {
-	webrtcSettings = webrtc.SettingEngine{}
-
-	if c.WebRTC.ICESinglePort != 0 {
-		log.Print("Listen on ", "single-port: ", c.WebRTC.ICESinglePort)
-		udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IP{0, 0, 0, 0},
-			Port: c.WebRTC.ICESinglePort,
-		})
-		if err != nil {
-			panic(err)
-		}
-		webrtcSettings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
-	} else {
-		var icePortStart, icePortEnd uint16
-
-		if len(c.WebRTC.ICEPortRange) == 2 {
-			icePortStart = c.WebRTC.ICEPortRange[0]
-			icePortEnd = c.WebRTC.ICEPortRange[1]
-		}
-		if icePortStart != 0 || icePortEnd != 0 {
-			if err := webrtcSettings.SetEphemeralUDPPortRange(icePortStart, icePortEnd); err != nil {
-				panic(err)
-			}
-		}
-	}
-
-	var iceServers []webrtc.ICEServer
-	if c.WebRTC.Candidates.IceLite {
-		webrtcSettings.SetLite(c.WebRTC.Candidates.IceLite)
-	} else {
-		for _, iceServer := range c.WebRTC.ICEServers {
-			s := webrtc.ICEServer{
-				URLs:       iceServer.URLs,
-				Username:   iceServer.Username,
-				Credential: iceServer.Credential,
-			}
-			iceServers = append(iceServers, s)
-		}
-	}
-
-	if len(c.WebRTC.Candidates.NAT1To1IPs) > 0 {
-		webrtcSettings.SetNAT1To1IPs(c.WebRTC.Candidates.NAT1To1IPs, webrtc.ICECandidateTypeHost)
-	}
+	WebRTC WebRTCConfig  `mapstructure:"webrtc"`
+	Codecs []CodecConfig `mapstructure:"codec"`
 }
 
+// WHIPConn is an ingest connection receiving the tracks of a publisher
 type WHIPConn struct {
-	pc                      *webrtc.PeerConnection
-	OnTrack                 func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
-	OnConnectionStateChange func(s webrtc.PeerConnectionState)
-	tracks                  []*webrtc.TrackRemote
+	*peer
+	OnTrack func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
+	lock    sync.RWMutex
+	tracks  []*webrtc.TrackRemote
 }
 
-func NewWHIPConn() (*WHIPConn, error) {
-
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mineTypePCMA, ClockRate: 8000},
-			PayloadType:        8,
-		},
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1", RTCPFeedback: nil},
-			PayloadType:        111,
-		},
-	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
-			return nil, err
-		}
-	}
-
-	videoRTCPFeedback := []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
-
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
-			PayloadType:        96,
-		},
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoRTCPFeedback},
-			PayloadType:        102,
-		},
-	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
-			return nil, err
-		}
-	}
-
-	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
-	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
-	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
-	// for each PeerConnection.
-	i := &interceptor.Registry{}
-
-	// Use the default set of Interceptors
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
-	}
-
-	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(webrtcSettings), webrtc.WithInterceptorRegistry(i))
-
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers:   []webrtc.ICEServer{},
-		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
-		//RTCPMuxPolicy: webrtc.RTCPMuxPolicyRequire,
-		BundlePolicy: webrtc.BundlePolicyBalanced,
-	}
-	// Create a new RTCPeerConnection
-	peerConnection, err := api.NewPeerConnection(config)
+// NewWHIPConn creates a WHIPConn using the settings of the engine. The engine
+// codecs are used unless codecs are given to override them for this connection.
+func (e *Engine) NewWHIPConn(codecs ...CodecConfig) (*WHIPConn, error) {
+	peer, err := e.newPeer(codecs, true)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	peerConnection := peer.pc
 
 	whip := &WHIPConn{
-		pc: peerConnection,
+		peer: peer,
 	}
 
 	// Accept one audio and one video track incoming
@@ -177,80 +73,81 @@ func NewWHIPConn() (*WHIPConn, error) {
 	}
 
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Track has started, of type %d: %s \n", track.PayloadType(), track.Codec().MimeType)
+		log.Printf("Track has started, of type %d: %s, rid: %q\n", track.PayloadType(), track.Codec().MimeType, track.RID())
+		whip.lock.Lock()
 		whip.tracks = append(whip.tracks, track)
+		whip.lock.Unlock()
 		if whip.OnTrack != nil {
 			go whip.OnTrack(peerConnection, track, receiver)
 		}
 	})
 
-	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Printf("Peer Connection State has changed: %s\n", s.String())
-		if whip.OnConnectionStateChange != nil {
-			go whip.OnConnectionStateChange(s)
-		}
-	})
-
 	return whip, nil
 }
 
-func (w *WHIPConn) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
-	return w.pc.AddTrack(track)
+// Tracks returns the remote tracks received so far. A simulcast publisher
+// has one track per layer, told apart by their RID.
+func (w *WHIPConn) Tracks() []*webrtc.TrackRemote {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return append([]*webrtc.TrackRemote(nil), w.tracks...)
 }
 
-func (w *WHIPConn) Offer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
-	// Set the remote SessionDescription
-	err := w.pc.SetRemoteDescription(offer)
-	if err != nil {
-		log.Printf("SetRemoteDescription err %v ", err)
-		w.pc.Close()
-		return nil, err
+// Stats returns a snapshot of the statistics of the connection and of the tracks it receives
+func (w *WHIPConn) Stats() *Stats {
+	stats := w.stats()
+	for _, track := range w.Tracks() {
+		for i := range stats.Tracks {
+			if stats.Tracks[i].SSRC == uint32(track.SSRC()) {
+				stats.Tracks[i].ID = track.ID()
+				stats.Tracks[i].RID = track.RID()
+			}
+		}
 	}
+	return stats
+}
 
-	// Create an answer
-	answer, err := w.pc.CreateAnswer(nil)
-	if err != nil {
-		log.Printf("CreateAnswer err %v ", err)
-		w.pc.Close()
-		return nil, err
-	}
+// LastPacket is the time the last RTP packet was received, zero before the first one
+func (w *WHIPConn) LastPacket() time.Time {
+	return w.statsInterceptor.lastReceived()
+}
 
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(w.pc)
+func (w *WHIPConn) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	return w.pc.AddTrack(track)
+}
 
-	// Sets the LocalDescription, and starts our UDP listeners
-	if err = w.pc.SetLocalDescription(answer); err != nil {
-		log.Printf("SetLocalDescription err %v ", err)
-		w.pc.Close()
-		return nil, err
-	}
+// SetMaxBitrate limits the video bitrate of the publisher, in bits per second, with
+// the b=AS line of the answer. It has to be set before Offer, 0 removes the limit.
+func (w *WHIPConn) SetMaxBitrate(bitrate int) {
+	w.maxBitrate = bitrate
+}
 
-	<-gatherComplete
+// Offer answers the offer of the publisher, gathering candidates for at most the
+// gather timeout of the engine
+func (w *WHIPConn) Offer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	ctx, cancel := w.gatherContext()
+	defer cancel()
+	return w.answer(ctx, offer)
+}
 
-	// Output the answer in base64 so we can paste it in browser
-	return w.pc.LocalDescription(), nil
+// OfferContext answers the offer of the publisher once ICE gathering is complete
+// or ctx is done, the candidates gathered later are returned by PendingCandidates
+func (w *WHIPConn) OfferContext(ctx context.Context, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	return w.answer(ctx, offer)
 }
 
-func (w *WHIPConn) AddICECandidate(candidate webrtc.ICECandidateInit) error {
-	return w.pc.AddICECandidate(candidate)
+// RequestKeyframe asks the publisher for a keyframe of a video track. The requests
+// made until the keyframe arrives are coalesced and they are rate limited, a PLI
+// is repeated while unanswered and then replaced by a FIR when negotiated.
+func (w *WHIPConn) RequestKeyframe(track *webrtc.TrackRemote) {
+	w.keyframes.request(uint32(track.SSRC()))
 }
 
+// PictureLossIndication requests a keyframe of every video track, see RequestKeyframe
 func (w *WHIPConn) PictureLossIndication() {
-	for _, track := range w.tracks {
+	for _, track := range w.Tracks() {
 		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			errSend := w.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-			if errSend != nil {
-				log.Println(errSend)
-				return
-			}
-		}
-	}
-}
-
-func (w *WHIPConn) Close() {
-	if w.pc != nil && w.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
-		if cErr := w.pc.Close(); cErr != nil {
-			log.Printf("cannot close peerConnection: %v\n", cErr)
+			w.RequestKeyframe(track)
 		}
 	}
 }